@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Identity is the authenticated user behind a request.
+type Identity struct {
+	Name   string
+	Method string   // "token", "basic", "proxy" or "oidc"
+	Groups []string // only known for OIDC logins
+}
+
+// Authenticator checks the credentials on a request. It reports false when
+// the request carries none it recognises, so the next one can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, bool)
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the identity the auth middleware attached to ctx,
+// or nil when authentication is disabled.
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// ownerOf is the name recorded on transfers created by r.
+func ownerOf(r *http.Request) string {
+	if id := identityFrom(r.Context()); id != nil {
+		return id.Name
+	}
+	return ""
+}
+
+// newAuthenticators builds the authenticators enabled in cfg. An empty
+// result means the API is open.
+func newAuthenticators(cfg Config) ([]Authenticator, error) {
+	var auths []Authenticator
+
+	if cfg.AuthProxyHeader != "" {
+		proxy, err := newProxyAuth(cfg.AuthProxyHeader, cfg.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, proxy)
+	}
+	if cfg.AuthTokensFile != "" {
+		tokens, err := loadTokenAuth(cfg.AuthTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, tokens)
+	}
+	if cfg.AuthHtpasswdFile != "" {
+		basic, err := loadBasicAuth(cfg.AuthHtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, basic)
+	}
+
+	return auths, nil
+}
+
+// requireAuth rejects requests that none of the server's authenticators
+// accept and records the identity of those that pass.
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.auth) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, a := range s.auth {
+			if id, ok := a.Authenticate(r); ok {
+				next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+				return
+			}
+		}
+
+		// Let browsers prompt for a password when basic auth is available
+		for _, a := range s.auth {
+			if _, ok := a.(*basicAuth); ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="wormhole-web", charset="UTF-8"`)
+				break
+			}
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Permissions granted through group membership
+const (
+	permSend    = "send"
+	permReceive = "receive"
+	permAdmin   = "admin"
+)
+
+// allowed reports whether id holds perm. Admins may do everything. Sending
+// and receiving are open to every user unless groups are configured for
+// them; admin always requires membership of an admin group. With
+// authentication disabled there are no admins.
+func (s *Server) allowed(id *Identity, perm string) bool {
+	if id == nil {
+		return len(s.auth) == 0 && perm != permAdmin
+	}
+	if inAnyGroup(id.Groups, s.config.AdminGroups) {
+		return true
+	}
+
+	switch perm {
+	case permSend:
+		return len(s.config.SendGroups) == 0 || inAnyGroup(id.Groups, s.config.SendGroups)
+	case permReceive:
+		return len(s.config.ReceiveGroups) == 0 || inAnyGroup(id.Groups, s.config.ReceiveGroups)
+	}
+	return false
+}
+
+func inAnyGroup(groups, wanted []string) bool {
+	for _, g := range groups {
+		for _, w := range wanted {
+			if g == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requirePermission guards a handler with one of the permissions above.
+func (s *Server) requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowed(identityFrom(r.Context()), perm) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleMe reports who the caller is and what they may do, so the UI can
+// hide what is not available.
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	id := identityFrom(r.Context())
+	resp := struct {
+		Name        string          `json:"name,omitempty"`
+		Method      string          `json:"method,omitempty"`
+		Groups      []string        `json:"groups,omitempty"`
+		Permissions map[string]bool `json:"permissions"`
+	}{
+		Permissions: map[string]bool{
+			permSend:    s.allowed(id, permSend),
+			permReceive: s.allowed(id, permReceive),
+			permAdmin:   s.allowed(id, permAdmin),
+		},
+	}
+	if id != nil {
+		resp.Name, resp.Method, resp.Groups = id.Name, id.Method, id.Groups
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readCredentialFile returns the "name:secret" pairs in path, skipping
+// blank lines and comments.
+func readCredentialFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pairs [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, secret, ok := strings.Cut(line, ":")
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:secret", path, n)
+		}
+		pairs = append(pairs, [2]string{name, secret})
+	}
+	return pairs, scanner.Err()
+}
+
+// tokenAuth accepts static bearer tokens read from a file with one
+// "name:token" per line.
+type tokenAuth struct {
+	// Keyed by the token's hash so lookups do not leak it through timing
+	names map[[sha256.Size]byte]string
+}
+
+func loadTokenAuth(path string) (*tokenAuth, error) {
+	pairs, err := readCredentialFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth tokens: %w", err)
+	}
+	t := &tokenAuth{names: make(map[[sha256.Size]byte]string, len(pairs))}
+	for _, p := range pairs {
+		t.names[sha256.Sum256([]byte(p[1]))] = p[0]
+	}
+	return t, nil
+}
+
+func (t *tokenAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, false
+	}
+	name, ok := t.names[sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))]
+	if !ok {
+		return nil, false
+	}
+	return &Identity{Name: name, Method: "token"}, true
+}
+
+// basicAuth checks HTTP basic credentials against an htpasswd file. Only
+// bcrypt hashes ("htpasswd -B") are supported.
+type basicAuth struct {
+	hashes map[string][]byte
+}
+
+func loadBasicAuth(path string) (*basicAuth, error) {
+	pairs, err := readCredentialFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("htpasswd: %w", err)
+	}
+	b := &basicAuth{hashes: make(map[string][]byte, len(pairs))}
+	for _, p := range pairs {
+		if _, err := bcrypt.Cost([]byte(p[1])); err != nil {
+			return nil, fmt.Errorf("htpasswd: user %q: only bcrypt hashes are supported", p[0])
+		}
+		b.hashes[p[0]] = []byte(p[1])
+	}
+	return b, nil
+}
+
+func (b *basicAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	hash, ok := b.hashes[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return nil, false
+	}
+	return &Identity{Name: user, Method: "basic"}, true
+}
+
+// proxyAuth trusts a user header set by a reverse proxy, but only on
+// connections coming from that proxy.
+type proxyAuth struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newProxyAuth(header string, trusted []string) (*proxyAuth, error) {
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("auth proxy header %q requires trusted proxies", header)
+	}
+	nets, err := parseTrustedProxies(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyAuth{header: header, trusted: nets}, nil
+}
+
+// parseTrustedProxies parses addresses and CIDRs; a bare address stands for
+// itself alone.
+func parseTrustedProxies(trusted []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range trusted {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func (p *proxyAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	user := r.Header.Get(p.header)
+	if user == "" {
+		return nil, false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !ipInNets(host, p.trusted) {
+		return nil, false
+	}
+	return &Identity{Name: user, Method: "proxy"}, true
+}
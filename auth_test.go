@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCredentials writes lines to a temp file and returns its path.
+func writeCredentials(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newAuthServer(t *testing.T) *Server {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(Config{
+		AuthTokensFile:   writeCredentials(t, "# CI uploads", "ci:s3cr3t-token"),
+		AuthHtpasswdFile: writeCredentials(t, "alice:"+string(hash)),
+		AuthProxyHeader:  "X-Forwarded-User",
+		TrustedProxies:   []string{"10.0.0.0/8"},
+	})
+	server.auth, err = newAuthenticators(server.config)
+	if err != nil {
+		t.Fatalf("newAuthenticators: %v", err)
+	}
+	return server
+}
+
+func TestRequireAuth(t *testing.T) {
+	server := newAuthServer(t)
+
+	var got *Identity
+	handler := server.requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = identityFrom(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		prepare    func(r *http.Request)
+		wantCode   int
+		wantUser   string
+		wantMethod string
+	}{
+		{"anonymous", func(r *http.Request) {}, http.StatusUnauthorized, "", ""},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t-token") }, http.StatusOK, "ci", "token"},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized, "", ""},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, http.StatusOK, "alice", "basic"},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "hunter3") }, http.StatusUnauthorized, "", ""},
+		{"trusted proxy", func(r *http.Request) {
+			r.RemoteAddr = "10.1.2.3:5000"
+			r.Header.Set("X-Forwarded-User", "bob")
+		}, http.StatusOK, "bob", "proxy"},
+		{"untrusted proxy", func(r *http.Request) {
+			r.RemoteAddr = "203.0.113.9:5000"
+			r.Header.Set("X-Forwarded-User", "bob")
+		}, http.StatusUnauthorized, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+			tt.prepare(req)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusUnauthorized {
+				if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+					t.Error("401 should offer basic auth")
+				}
+				return
+			}
+			if got == nil || got.Name != tt.wantUser || got.Method != tt.wantMethod {
+				t.Errorf("identity = %+v, want %s via %s", got, tt.wantUser, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestRequireAuthDisabled(t *testing.T) {
+	server := NewServer(Config{})
+
+	w := httptest.NewRecorder()
+	server.requireAuth(http.HandlerFunc(server.handleConfig)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestNewAuthenticatorsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"missing tokens file", Config{AuthTokensFile: filepath.Join(t.TempDir(), "missing")}},
+		{"malformed tokens file", Config{AuthTokensFile: writeCredentials(t, "just-a-token")}},
+		{"non-bcrypt htpasswd", Config{AuthHtpasswdFile: writeCredentials(t, "alice:$apr1$abc$def")}},
+		{"proxy without trusted proxies", Config{AuthProxyHeader: "X-Forwarded-User"}},
+		{"invalid trusted proxy", Config{AuthProxyHeader: "X-Forwarded-User", TrustedProxies: []string{"not-an-ip"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newAuthenticators(tt.cfg); err == nil {
+				t.Error("newAuthenticators should fail")
+			}
+		})
+	}
+}
+
+func TestTransferOwner(t *testing.T) {
+	server := newAuthServer(t)
+	server.config.RendezvousURL = newTestRendezvous(t).RendezvousURL
+	handler := server.requireAuth(http.HandlerFunc(server.handleSendText))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/send/text", strings.NewReader(`{"text":"hi"}`))
+	req.SetBasicAuth("alice", "hunter2")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	defer server.cancelTransfer(resp.ID)
+
+	if got := server.getTransfer(resp.ID); got == nil || got.Owner != "alice" {
+		t.Fatalf("transfer = %+v, want owner alice", got)
+	}
+
+	// The owner can follow the transfer without its capability; others cannot
+	status := server.requireAuth(http.HandlerFunc(server.handleStatus))
+	for user, want := range map[string]int{"alice": http.StatusOK, "bob": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/api/status?id="+resp.ID, nil)
+		req.RemoteAddr = "10.0.0.1:4000"
+		req.Header.Set("X-Forwarded-User", user)
+		w := httptest.NewRecorder()
+		status.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("status as %s: got %d, want %d", user, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/psanford/wormhole-william/wordlist"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+var (
+	errInvalidCode         = errors.New("invalid wormhole code format")
+	errCustomCodesDisabled = errors.New("custom codes are disabled on this server")
+	errCodeInUse           = errors.New("code is already in use by another transfer")
+	// errCodeClaimTimeout wraps context.DeadlineExceeded so metrics count
+	// it as a timeout.
+	errCodeClaimTimeout = fmt.Errorf("timed out claiming the code: %w", context.DeadlineExceeded)
+)
+
+// codeClaimTimeout is how long a send with a custom code may take to claim
+// its nameplate. The mailbox answers a claim on a nameplate that already
+// has two sides with an error the wormhole library never returns, so such
+// a claim looks just like a slow or unreachable mailbox: it never ends.
+const codeClaimTimeout = 15 * time.Second
+
+// codeWords is the PGP wordlist generated codes are made of, sorted for
+// completion. A word from either half is accepted at any position: clients
+// do not agree on which half a position draws from.
+var codeWords = func() []string {
+	words := make([]string, 0, 2*len(wordlist.RawWords))
+	for _, pair := range wordlist.RawWords {
+		words = append(words, pair.Even, pair.Odd)
+	}
+	sort.Strings(words)
+	return words
+}()
+
+// isCodeWord reports whether word, in any case, is on the wordlist.
+func isCodeWord(word string) bool {
+	word = strings.ToLower(word)
+	i := sort.SearchStrings(codeWords, word)
+	return i < len(codeWords) && codeWords[i] == word
+}
+
+// completeCode returns the codes that complete the last word of prefix,
+// such as "7-guitarist-re" to "7-guitarist-revenge" and
+// "7-guitarist-retouch". The words before it must already be valid.
+// Completions are lowercase, like the codes they complete.
+func completeCode(prefix string) []string {
+	completions := []string{}
+	prefix = strings.ToLower(prefix)
+	n, rest, ok := strings.Cut(prefix, "-")
+	if !ok || !nameplatePattern.MatchString(n) {
+		return completions
+	}
+	words := strings.Split(rest, "-")
+	for _, word := range words[:len(words)-1] {
+		if !isCodeWord(word) {
+			return completions
+		}
+	}
+
+	partial := words[len(words)-1]
+	head := prefix[:len(prefix)-len(partial)]
+	for i := sort.SearchStrings(codeWords, partial); i < len(codeWords) && strings.HasPrefix(codeWords[i], partial); i++ {
+		completions = append(completions, head+codeWords[i])
+	}
+	return completions
+}
+
+// handleCompleteCode serves GET /api/codes/complete?prefix=, the
+// completions of a partly typed code.
+func (s *Server) handleCompleteCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Completions []string `json:"completions"`
+	}{
+		Completions: completeCode(r.URL.Query().Get("prefix")),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// nameplate returns the number a wormhole code starts with.
+func nameplate(code string) string {
+	n, _, _ := strings.Cut(code, "-")
+	return n
+}
+
+// setSendTransfer stores a new send like setTransfer. A send with a custom
+// code is refused if another unfinished send on this server already uses
+// its nameplate; the check and the store happen under one lock so two
+// requests cannot both win.
+func (s *Server) setSendTransfer(t *TransferStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.Code != "" {
+		var taken bool
+		s.store.Range(func(other *TransferStatus) bool {
+			taken = other.Type == "send" && !other.finished() && other.Code != "" &&
+				nameplate(other.Code) == nameplate(t.Code)
+			return !taken
+		})
+		if taken {
+			return errCodeInUse
+		}
+	}
+	snapshot := *t
+	s.commit(s.store.Get(t.ID), &snapshot)
+	return nil
+}
+
+// checkSendCode validates a code requested for a send and returns it in
+// lowercase, as receivers type it. An empty code asks the mailbox for a
+// random one.
+func (s *Server) checkSendCode(code string) (string, error) {
+	if code == "" {
+		return "", nil
+	}
+	if s.config.DisableCustomCodes {
+		return "", errCustomCodesDisabled
+	}
+	if !validateWormholeCode(code) {
+		return "", errInvalidCode
+	}
+	return strings.ToLower(code), nil
+}
+
+// sendCodeOptions returns the options that make a send use code, if one
+// was chosen, and a function to call once the send has claimed it. Until
+// then a watchdog aborts the transfer after codeClaimTimeout.
+func (s *Server) sendCodeOptions(id, code string) ([]wormhole.SendOption, func()) {
+	if code == "" {
+		return nil, func() {}
+	}
+	watchdog := time.AfterFunc(codeClaimTimeout, func() {
+		s.abortTransfer(id, fmt.Errorf("%w: the mailbox did not answer, or nameplate %s is taken", errCodeClaimTimeout, nameplate(code)))
+	})
+	return []wormhole.SendOption{wormhole.WithCode(code)}, func() { watchdog.Stop() }
+}
+
+func writeSendCodeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidCode):
+		http.Error(w, "Invalid wormhole code format", http.StatusBadRequest)
+	case errors.Is(err, errCustomCodesDisabled):
+		http.Error(w, "Custom codes are disabled", http.StatusForbidden)
+	case errors.Is(err, errCodeInUse):
+		http.Error(w, "Code is already in use by another transfer", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// sendTextRequest posts body to /api/send/text and returns the response.
+func sendTextRequest(server *Server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/send/text", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.handleSendText(w, req)
+	return w
+}
+
+func TestSendCustomCode(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+
+	w := sendTextRequest(server, `{"text":"release notes","code":"42-release-bundle"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleSendText: got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if code := waitForStatus(t, server, resp.ID, "waiting").Code; code != "42-release-bundle" {
+		t.Fatalf("Code = %q, want the chosen one", code)
+	}
+
+	receiver := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	msg, err := receiver.Receive(context.Background(), "42-release-bundle")
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	text, _ := io.ReadAll(msg)
+	if string(text) != "release notes" {
+		t.Errorf("received %q", text)
+	}
+	waitForStatus(t, server, resp.ID, "complete")
+}
+
+func TestReceiveUppercaseCode(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+
+	sender := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	code, _, err := sender.SendText(context.Background(), "shouted")
+	if err != nil {
+		t.Fatalf("SendText: %v", err)
+	}
+
+	id := startReceive(t, server, strings.ToUpper(code))
+	done := waitForStatus(t, server, id, "complete")
+	if done.TextContent != "shouted" {
+		t.Errorf("TextContent = %q", done.TextContent)
+	}
+	if done.Code != code {
+		t.Errorf("Code = %q, want %q", done.Code, code)
+	}
+}
+
+func TestSendCustomCodeRefused(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+
+	if w := sendTextRequest(server, `{"text":"x","code":"42 release"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed code: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := sendTextRequest(server, `{"text":"x","code":"42-release-bundle"}`); w.Code != http.StatusOK {
+		t.Fatalf("first send: got status %d", w.Code)
+	}
+	// Another code on the same nameplate would claim the same mailbox
+	if w := sendTextRequest(server, `{"text":"x","code":"42-other-words"}`); w.Code != http.StatusConflict {
+		t.Errorf("taken nameplate: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	cfg.DisableCustomCodes = true
+	server = NewServer(cfg)
+	if w := sendTextRequest(server, `{"text":"x","code":"43-release-bundle"}`); w.Code != http.StatusForbidden {
+		t.Errorf("disabled: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestCompleteCode(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"7-guitarist-rev", []string{"7-guitarist-revenge", "7-guitarist-revenue", "7-guitarist-revival", "7-guitarist-revolver"}},
+		{"7-Guit", []string{"7-guitarist"}},
+		{"7-GUITARIST-REVENGE-TOB", []string{"7-guitarist-revenge-tobacco"}},
+		{"7-guitarist-revenge-tob", []string{"7-guitarist-revenge-tobacco"}},
+		{"7-guitarist-xyz", []string{}},
+		{"7-guitarst-rev", []string{}},
+		{"guitarist", []string{}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		got := completeCode(tt.prefix)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") || got == nil {
+			t.Errorf("completeCode(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+	if got := completeCode("7-"); len(got) != len(codeWords) {
+		t.Errorf("completeCode(\"7-\") returned %d words, want all %d", len(got), len(codeWords))
+	}
+}
+
+func TestHandleCompleteCode(t *testing.T) {
+	server := NewServer(Config{})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/codes/complete?prefix=7-zul", nil)
+	w := httptest.NewRecorder()
+	server.handleCompleteCode(w, req)
+
+	var resp struct {
+		Completions []string `json:"completions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Completions) != 1 || resp.Completions[0] != "7-zulu" {
+		t.Errorf("completions = %q", resp.Completions)
+	}
+}
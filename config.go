@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// Config holds server-wide settings. Its zero value talks to the public
+// Magic Wormhole infrastructure, just like a zero-value wormhole.Client.
+type Config struct {
+	Port string
+
+	// RendezvousURL is the websocket URL of the mailbox server.
+	RendezvousURL string
+	// ServeMailbox is the address an embedded mailbox server listens on,
+	// such as ":4000". Empty disables it. Without a RendezvousURL, this
+	// server's own transfers use it.
+	ServeMailbox string
+	// TransitRelayURL is the transit relay used when peers cannot connect
+	// directly. Accepts "host:port" or "tcp:host:port".
+	TransitRelayURL string
+	// ServeTransit is the address an embedded transit relay listens on
+	// for TCP peers, such as ":4001", and ServeTransitWS the address it
+	// listens on for WebSocket peers. Empty disables each. Without a
+	// TransitRelayURL, this server's own transfers use it.
+	ServeTransit   string
+	ServeTransitWS string
+	// TransitAdvertiseHost is the host peers are told to reach the
+	// embedded relay at. Empty means the host of OIDCRedirectURL, the
+	// listening address, or failing those a detected one.
+	TransitAdvertiseHost string
+	// TransitMaxRate caps each relayed connection in bytes per second, and
+	// TransitMaxBytes caps what it may move. Zero means no cap.
+	TransitMaxRate  int64
+	TransitMaxBytes int64
+	// AppID must match the AppID of the peers we talk to.
+	AppID string
+	// PassPhraseComponentLength is the number of words in generated codes.
+	PassPhraseComponentLength int
+	// DisableCustomCodes makes senders always take a code from the
+	// mailbox instead of choosing their own.
+	DisableCustomCodes bool
+
+	// AllowedOrigins are extra browser origins, besides the server's own,
+	// that may open WebSockets and start transfers.
+	AllowedOrigins []string
+
+	// RateLimit is how many transfers a client (user or IP) may start per
+	// minute, with bursts of up to RateBurst. Zero disables rate limiting.
+	RateLimit int
+	RateBurst int
+	// MaxActiveTransfers caps transfers running at once; more wait in the
+	// "queued" status, up to MaxQueuedTransfers. Zero means no cap.
+	MaxActiveTransfers int
+	MaxQueuedTransfers int
+
+	// MaxUploadSize caps the request body of /api/send/file in bytes.
+	// Zero means defaultMaxUploadSize.
+	MaxUploadSize int64
+
+	// LogFormat is "text" or "json"; LogLevel is debug, info, warn or error.
+	LogFormat string
+	LogLevel  string
+
+	// MinFreeSpace is the free space, in bytes, the temp dir needs for
+	// /readyz to pass. Zero skips the check.
+	MinFreeSpace int64
+	// ReadyCheckRendezvous makes /readyz also require a reachable
+	// rendezvous server.
+	ReadyCheckRendezvous bool
+
+	// DrainTimeout is how long shutdown waits for active transfers before
+	// cancelling them.
+	DrainTimeout time.Duration
+
+	// ProgressInterval is how often the bytes a transfer has moved are
+	// published to its subscribers.
+	ProgressInterval time.Duration
+
+	// DataDir enables the persistent transfer store. Empty keeps transfers
+	// in memory only.
+	DataDir string
+
+	// AuthTokensFile lists static API tokens, one "name:token" per line.
+	AuthTokensFile string
+	// AuthHtpasswdFile enables HTTP basic auth against bcrypt hashes.
+	AuthHtpasswdFile string
+	// AuthProxyHeader names a header carrying the user, set by a reverse
+	// proxy that already authenticated the request.
+	AuthProxyHeader string
+	// TrustedProxies are the addresses or CIDRs AuthProxyHeader is accepted
+	// from.
+	TrustedProxies []string
+
+	// OIDCIssuer enables OpenID Connect login against this issuer.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// OIDCRedirectURL is this server's public /auth/callback URL.
+	OIDCRedirectURL string
+	// OIDCGroupsClaim names the ID token claim listing the user's groups.
+	OIDCGroupsClaim string
+
+	// SendGroups and ReceiveGroups restrict sending and receiving to
+	// members of these groups; empty allows every authenticated user.
+	// AdminGroups may do everything, including other users' transfers.
+	SendGroups    []string
+	ReceiveGroups []string
+	AdminGroups   []string
+}
+
+const defaultMaxUploadSize = 500 << 20
+
+// loadConfig builds a Config from environment variables, overridden by
+// command line flags.
+func loadConfig(args []string) (Config, error) {
+	var cfg Config
+	var env envValues
+
+	fset := flag.NewFlagSet("wormhole-web", flag.ContinueOnError)
+	fset.StringVar(&cfg.Port, "port", envOr("PORT", "8080"), "HTTP server port")
+	fset.StringVar(&cfg.RendezvousURL, "rendezvous-url", os.Getenv("WORMHOLE_RENDEZVOUS_URL"), "Rendezvous (mailbox) server URL")
+	fset.StringVar(&cfg.ServeMailbox, "serve-mailbox", os.Getenv("WORMHOLE_SERVE_MAILBOX"), "Run an embedded rendezvous (mailbox) server on this address, e.g. :4000")
+	fset.StringVar(&cfg.TransitRelayURL, "transit-relay", os.Getenv("WORMHOLE_TRANSIT_RELAY"), "Transit relay address (host:port)")
+	fset.StringVar(&cfg.ServeTransit, "serve-transit", os.Getenv("WORMHOLE_SERVE_TRANSIT"), "Run an embedded transit relay for TCP peers on this address, e.g. :4001")
+	fset.StringVar(&cfg.ServeTransitWS, "serve-transit-ws", os.Getenv("WORMHOLE_SERVE_TRANSIT_WS"), "Also serve the transit relay to WebSocket peers on this address, e.g. :4002")
+	fset.StringVar(&cfg.TransitAdvertiseHost, "transit-advertise-host", os.Getenv("WORMHOLE_TRANSIT_ADVERTISE_HOST"), "Host peers reach the embedded transit relay at (default: this server's public host)")
+	transitMaxRateKB := fset.Int("transit-max-rate-kb", env.Int("WORMHOLE_TRANSIT_MAX_RATE_KB", 0), "Bandwidth cap in KiB/s per relayed connection (0 for no cap)")
+	transitMaxMB := fset.Int("transit-max-mb", env.Int("WORMHOLE_TRANSIT_MAX_MB", 0), "MiB a relayed connection may move (0 for no cap)")
+	fset.StringVar(&cfg.AppID, "app-id", os.Getenv("WORMHOLE_APP_ID"), "Wormhole AppID")
+	fset.IntVar(&cfg.PassPhraseComponentLength, "code-words", env.Int("WORMHOLE_CODE_WORDS", 0), "Number of words in generated codes")
+	fset.BoolVar(&cfg.DisableCustomCodes, "disable-custom-codes", env.Bool("WORMHOLE_DISABLE_CUSTOM_CODES"), "Refuse sends that choose their own code")
+	fset.StringVar(&cfg.DataDir, "data-dir", os.Getenv("WORMHOLE_DATA_DIR"), "Directory for persistent transfer state (default: in-memory)")
+	allowedOrigins := fset.String("allowed-origins", os.Getenv("WORMHOLE_ALLOWED_ORIGINS"), "Comma-separated extra origins allowed to use the API, e.g. https://wormhole.example.com")
+	fset.StringVar(&cfg.AuthTokensFile, "auth-tokens-file", os.Getenv("WORMHOLE_AUTH_TOKENS_FILE"), "File of name:token API tokens")
+	fset.StringVar(&cfg.AuthHtpasswdFile, "auth-htpasswd", os.Getenv("WORMHOLE_AUTH_HTPASSWD"), "htpasswd file (bcrypt) for HTTP basic auth")
+	fset.StringVar(&cfg.AuthProxyHeader, "auth-proxy-header", os.Getenv("WORMHOLE_AUTH_PROXY_HEADER"), "Header carrying the user from a trusted reverse proxy, e.g. X-Forwarded-User")
+	trustedProxies := fset.String("trusted-proxies", os.Getenv("WORMHOLE_TRUSTED_PROXIES"), "Comma-separated addresses or CIDRs of trusted reverse proxies")
+	fset.StringVar(&cfg.OIDCIssuer, "oidc-issuer", os.Getenv("WORMHOLE_OIDC_ISSUER"), "OpenID Connect issuer URL")
+	fset.StringVar(&cfg.OIDCClientID, "oidc-client-id", os.Getenv("WORMHOLE_OIDC_CLIENT_ID"), "OpenID Connect client ID")
+	fset.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", os.Getenv("WORMHOLE_OIDC_CLIENT_SECRET"), "OpenID Connect client secret")
+	fset.StringVar(&cfg.OIDCRedirectURL, "oidc-redirect-url", os.Getenv("WORMHOLE_OIDC_REDIRECT_URL"), "Public URL of /auth/callback")
+	fset.StringVar(&cfg.OIDCGroupsClaim, "oidc-groups-claim", envOr("WORMHOLE_OIDC_GROUPS_CLAIM", "groups"), "ID token claim holding the user's groups")
+	sendGroups := fset.String("send-groups", os.Getenv("WORMHOLE_SEND_GROUPS"), "Comma-separated groups allowed to send (default: everyone)")
+	receiveGroups := fset.String("receive-groups", os.Getenv("WORMHOLE_RECEIVE_GROUPS"), "Comma-separated groups allowed to receive (default: everyone)")
+	adminGroups := fset.String("admin-groups", os.Getenv("WORMHOLE_ADMIN_GROUPS"), "Comma-separated groups with admin rights")
+	fset.IntVar(&cfg.RateLimit, "rate-limit", env.Int("WORMHOLE_RATE_LIMIT", 0), "Transfers a client may start per minute (0 disables)")
+	fset.IntVar(&cfg.RateBurst, "rate-burst", env.Int("WORMHOLE_RATE_BURST", 10), "Transfers a client may start in a burst")
+	fset.IntVar(&cfg.MaxActiveTransfers, "max-active-transfers", env.Int("WORMHOLE_MAX_ACTIVE_TRANSFERS", 50), "Transfers moving data at once (0 for no cap)")
+	fset.IntVar(&cfg.MaxQueuedTransfers, "max-queued-transfers", env.Int("WORMHOLE_MAX_QUEUED_TRANSFERS", 100), "Transfers waiting for a free slot before requests are refused")
+	fset.StringVar(&cfg.LogFormat, "log-format", envOr("WORMHOLE_LOG_FORMAT", "text"), "Log format: text or json")
+	fset.StringVar(&cfg.LogLevel, "log-level", envOr("WORMHOLE_LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	minFreeMB := fset.Int("min-free-mb", env.Int("WORMHOLE_MIN_FREE_MB", 100), "Free space in MiB the temp dir needs to report ready (0 skips the check)")
+	fset.BoolVar(&cfg.ReadyCheckRendezvous, "ready-check-rendezvous", env.Bool("WORMHOLE_READY_CHECK_RENDEZVOUS"), "Report not ready while the rendezvous server is unreachable")
+	fset.DurationVar(&cfg.DrainTimeout, "drain-timeout", env.Duration("WORMHOLE_DRAIN_TIMEOUT", 30*time.Second), "How long shutdown waits for active transfers to finish")
+	fset.DurationVar(&cfg.ProgressInterval, "progress-interval", env.Duration("WORMHOLE_PROGRESS_INTERVAL", 100*time.Millisecond), "How often transfer progress is pushed to clients")
+	maxUploadMB := fset.Int("max-upload-mb", env.Int("WORMHOLE_MAX_UPLOAD_MB", defaultMaxUploadSize>>20), "Maximum upload size in MiB")
+	if err := fset.Parse(args); err != nil {
+		return cfg, err
+	}
+	if env.err != nil {
+		return cfg, env.err
+	}
+
+	if *maxUploadMB <= 0 {
+		return cfg, fmt.Errorf("invalid max upload size %d MiB", *maxUploadMB)
+	}
+	cfg.MaxUploadSize = int64(*maxUploadMB) << 20
+	if *minFreeMB < 0 {
+		return cfg, fmt.Errorf("invalid minimum free space %d MiB", *minFreeMB)
+	}
+	cfg.MinFreeSpace = int64(*minFreeMB) << 20
+
+	if cfg.ServeMailbox != "" {
+		if _, _, err := net.SplitHostPort(cfg.ServeMailbox); err != nil {
+			return cfg, fmt.Errorf("invalid mailbox address %q: %w", cfg.ServeMailbox, err)
+		}
+	}
+	for _, addr := range []string{cfg.ServeTransit, cfg.ServeTransitWS} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return cfg, fmt.Errorf("invalid transit relay address %q: %w", addr, err)
+		}
+	}
+	if *transitMaxRateKB < 0 || *transitMaxMB < 0 {
+		return cfg, fmt.Errorf("transit relay limits must not be negative")
+	}
+	cfg.TransitMaxRate = int64(*transitMaxRateKB) << 10
+	cfg.TransitMaxBytes = int64(*transitMaxMB) << 20
+	if cfg.TransitRelayURL != "" {
+		if _, _, err := net.SplitHostPort(cfg.transitRelayAddress()); err != nil {
+			return cfg, fmt.Errorf("invalid transit relay %q: %w", cfg.TransitRelayURL, err)
+		}
+	}
+	cfg.AllowedOrigins = splitList(*allowedOrigins)
+	for _, origin := range cfg.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return cfg, fmt.Errorf("invalid allowed origin %q: want scheme://host[:port]", origin)
+		}
+	}
+	cfg.TrustedProxies = splitList(*trustedProxies)
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return cfg, err
+	}
+	cfg.SendGroups = splitList(*sendGroups)
+	cfg.ReceiveGroups = splitList(*receiveGroups)
+	cfg.AdminGroups = splitList(*adminGroups)
+	if cfg.AuthProxyHeader != "" && len(cfg.TrustedProxies) == 0 {
+		return cfg, fmt.Errorf("-auth-proxy-header requires -trusted-proxies")
+	}
+
+	if cfg.OIDCIssuer != "" && (cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "") {
+		return cfg, fmt.Errorf("-oidc-issuer requires -oidc-client-id and -oidc-redirect-url")
+	}
+
+	if cfg.DrainTimeout < 0 {
+		return cfg, fmt.Errorf("invalid drain timeout %v", cfg.DrainTimeout)
+	}
+	if cfg.ProgressInterval <= 0 {
+		return cfg, fmt.Errorf("invalid progress interval %v", cfg.ProgressInterval)
+	}
+
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 || cfg.MaxActiveTransfers < 0 || cfg.MaxQueuedTransfers < 0 {
+		return cfg, fmt.Errorf("rate and transfer limits must not be negative")
+	}
+
+	if _, err := newLogger(io.Discard, cfg.LogFormat, cfg.LogLevel); err != nil {
+		return cfg, err
+	}
+
+	if cfg.PassPhraseComponentLength < 0 {
+		return cfg, fmt.Errorf("invalid code word count %d", cfg.PassPhraseComponentLength)
+	}
+
+	return cfg, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envValues reads typed settings from the environment. The first value
+// that does not parse is kept in err, so a typo fails startup with the
+// variable's name instead of quietly falling back to the default.
+type envValues struct {
+	err error
+}
+
+func (e *envValues) invalid(key, v string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid %s %q", key, v)
+	}
+}
+
+func (e *envValues) Int(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.invalid(key, v)
+		return def
+	}
+	return n
+}
+
+func (e *envValues) Duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.invalid(key, v)
+		return def
+	}
+	return d
+}
+
+func (e *envValues) Bool(key string) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.invalid(key, v)
+	}
+	return b
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// transitRelayAddress strips an optional "tcp:" scheme so the value can be
+// handed to wormhole.Client, which expects a bare host:port.
+func (c Config) transitRelayAddress() string {
+	addr := strings.TrimPrefix(c.TransitRelayURL, "tcp://")
+	return strings.TrimPrefix(addr, "tcp:")
+}
+
+// transitAdvertiseHost is the host the embedded relay is handed to peers
+// at, or "" to work it out from the listening address.
+func (c Config) transitAdvertiseHost() string {
+	if c.TransitAdvertiseHost != "" {
+		return c.TransitAdvertiseHost
+	}
+	if c.OIDCRedirectURL != "" {
+		if u, err := url.Parse(c.OIDCRedirectURL); err == nil {
+			return u.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(c.ServeTransit); err == nil {
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			return host
+		}
+	}
+	return ""
+}
+
+func (c Config) maxUploadSize() int64 {
+	if c.MaxUploadSize > 0 {
+		return c.MaxUploadSize
+	}
+	return defaultMaxUploadSize
+}
+
+// newClient returns a wormhole client wired to the configured infrastructure.
+func (s *Server) newClient() wormhole.Client {
+	return wormhole.Client{
+		AppID:                     s.config.AppID,
+		RendezvousURL:             s.config.RendezvousURL,
+		TransitRelayAddress:       s.config.transitRelayAddress(),
+		PassPhraseComponentLength: s.config.PassPhraseComponentLength,
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg := s.config
+	resp := struct {
+		RendezvousURL             string `json:"rendezvousURL"`
+		TransitRelayURL           string `json:"transitRelayURL"`
+		AppID                     string `json:"appID"`
+		PassPhraseComponentLength int    `json:"passPhraseComponentLength"`
+		CustomCodes               bool   `json:"customCodes"`
+		MaxUploadSize             int64  `json:"maxUploadSize"`
+	}{
+		RendezvousURL:             cfg.RendezvousURL,
+		TransitRelayURL:           cfg.transitRelayAddress(),
+		AppID:                     cfg.AppID,
+		PassPhraseComponentLength: cfg.PassPhraseComponentLength,
+		CustomCodes:               !cfg.DisableCustomCodes,
+		MaxUploadSize:             cfg.maxUploadSize(),
+	}
+
+	// Report the effective values rather than blanks
+	if resp.RendezvousURL == "" {
+		resp.RendezvousURL = wormhole.DefaultRendezvousURL
+	}
+	if resp.TransitRelayURL == "" {
+		resp.TransitRelayURL = wormhole.DefaultTransitRelayAddress
+	}
+	if resp.AppID == "" {
+		resp.AppID = wormhole.WormholeCLIAppID
+	}
+	if resp.PassPhraseComponentLength < 2 {
+		resp.PassPhraseComponentLength = 2
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
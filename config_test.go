@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("WORMHOLE_RENDEZVOUS_URL", "")
+
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Port != "8080" {
+		t.Errorf("Port = %q, want %q", cfg.Port, "8080")
+	}
+	if cfg.RendezvousURL != "" {
+		t.Errorf("RendezvousURL = %q, want empty", cfg.RendezvousURL)
+	}
+	if cfg.MaxUploadSize != 500<<20 {
+		t.Errorf("MaxUploadSize = %d, want %d", cfg.MaxUploadSize, 500<<20)
+	}
+}
+
+func TestLoadConfigEnvAndFlags(t *testing.T) {
+	t.Setenv("WORMHOLE_RENDEZVOUS_URL", "ws://env.example:4000/v1")
+	t.Setenv("WORMHOLE_APP_ID", "example.com/wormhole")
+	t.Setenv("WORMHOLE_CODE_WORDS", "3")
+
+	cfg, err := loadConfig([]string{
+		"-rendezvous-url", "ws://flag.example:4000/v1",
+		"-transit-relay", "tcp:relay.example:4001",
+		"-max-upload-mb", "2048",
+	})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	// Flags win over env
+	if cfg.RendezvousURL != "ws://flag.example:4000/v1" {
+		t.Errorf("RendezvousURL = %q", cfg.RendezvousURL)
+	}
+	if cfg.AppID != "example.com/wormhole" {
+		t.Errorf("AppID = %q", cfg.AppID)
+	}
+	if cfg.PassPhraseComponentLength != 3 {
+		t.Errorf("PassPhraseComponentLength = %d, want 3", cfg.PassPhraseComponentLength)
+	}
+	if cfg.MaxUploadSize != 2048<<20 {
+		t.Errorf("MaxUploadSize = %d, want %d", cfg.MaxUploadSize, int64(2048)<<20)
+	}
+
+	c := NewServer(cfg).newClient()
+	if c.TransitRelayAddress != "relay.example:4001" {
+		t.Errorf("TransitRelayAddress = %q, want %q", c.TransitRelayAddress, "relay.example:4001")
+	}
+	if c.RendezvousURL != cfg.RendezvousURL || c.AppID != cfg.AppID {
+		t.Errorf("newClient did not apply config: %+v", c)
+	}
+}
+
+func TestLoadConfigInvalidEnv(t *testing.T) {
+	for key, v := range map[string]string{
+		"WORMHOLE_RATE_LIMIT":             "ten",
+		"WORMHOLE_MAX_UPLOAD_MB":          "1.5",
+		"WORMHOLE_DRAIN_TIMEOUT":          "30",
+		"WORMHOLE_READY_CHECK_RENDEZVOUS": "yes",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, v)
+			_, err := loadConfig(nil)
+			if err == nil || !strings.Contains(err.Error(), key) {
+				t.Errorf("loadConfig error = %v, want one naming %s", err, key)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidRelay(t *testing.T) {
+	if _, err := loadConfig([]string{"-transit-relay", "no-port"}); err == nil {
+		t.Error("loadConfig should reject a relay without a port")
+	}
+	if _, err := loadConfig([]string{"-serve-mailbox", "4000"}); err == nil {
+		t.Error("loadConfig should reject a mailbox address without a port")
+	}
+	if _, err := loadConfig([]string{"-serve-transit-ws", "4002"}); err == nil {
+		t.Error("loadConfig should reject a transit relay address without a port")
+	}
+	if _, err := loadConfig([]string{"-serve-transit", ":4001", "-transit-max-mb", "-1"}); err == nil {
+		t.Error("loadConfig should reject a negative transit byte cap")
+	}
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.RateLimit != 0 {
+		t.Errorf("rate limiting should be off by default, got %d", cfg.RateLimit)
+	}
+
+	cfg, err = loadConfig([]string{"-rate-limit", "5", "-max-active-transfers", "0"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.RateLimit != 5 || cfg.RateBurst != 10 || cfg.MaxActiveTransfers != 0 || cfg.MaxQueuedTransfers != 100 {
+		t.Errorf("limits = %d/%d/%d/%d", cfg.RateLimit, cfg.RateBurst, cfg.MaxActiveTransfers, cfg.MaxQueuedTransfers)
+	}
+
+	if _, err := loadConfig([]string{"-rate-burst", "-1"}); err == nil {
+		t.Error("loadConfig should reject negative limits")
+	}
+}
+
+func TestLoadConfigLogging(t *testing.T) {
+	cfg, err := loadConfig([]string{"-log-format", "json", "-log-level", "debug"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.LogFormat != "json" || cfg.LogLevel != "debug" {
+		t.Errorf("logging = %q/%q", cfg.LogFormat, cfg.LogLevel)
+	}
+	if _, err := loadConfig([]string{"-log-format", "logfmt"}); err == nil {
+		t.Error("loadConfig should reject unknown log formats")
+	}
+}
+
+func TestLoadConfigProgressInterval(t *testing.T) {
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.ProgressInterval != 100*time.Millisecond {
+		t.Errorf("default ProgressInterval = %v", cfg.ProgressInterval)
+	}
+	for _, v := range []string{"0", "-1s"} {
+		if _, err := loadConfig([]string{"-progress-interval", v}); err == nil {
+			t.Errorf("loadConfig should reject progress interval %s", v)
+		}
+	}
+}
+
+func TestLoadConfigAuth(t *testing.T) {
+	cfg, err := loadConfig([]string{
+		"-auth-proxy-header", "X-Forwarded-User",
+		"-trusted-proxies", "10.0.0.0/8, 192.168.1.1,",
+	})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if strings.Join(cfg.TrustedProxies, "|") != "10.0.0.0/8|192.168.1.1" {
+		t.Errorf("TrustedProxies = %q", cfg.TrustedProxies)
+	}
+
+	if _, err := loadConfig([]string{"-allowed-origins", "wormhole.example.com"}); err == nil {
+		t.Error("loadConfig should reject an origin without a scheme")
+	}
+	if _, err := loadConfig([]string{"-auth-proxy-header", "X-Forwarded-User"}); err == nil {
+		t.Error("loadConfig should require trusted proxies for the proxy header")
+	}
+}
+
+func TestHandleConfig(t *testing.T) {
+	server := NewServer(Config{RendezvousURL: "ws://mailbox.internal:4000/v1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	w := httptest.NewRecorder()
+
+	server.handleConfig(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleConfig: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp["rendezvousURL"] != "ws://mailbox.internal:4000/v1" {
+		t.Errorf("rendezvousURL = %v", resp["rendezvousURL"])
+	}
+	// Unset values report the library defaults
+	if resp["transitRelayURL"] == "" || resp["appID"] == "" {
+		t.Errorf("defaults not reported: %v", resp)
+	}
+}
+
+func TestTransitAdvertiseHost(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{ServeTransit: ":4001", TransitAdvertiseHost: "relay.example", OIDCRedirectURL: "https://wormhole.example/auth/callback"}, "relay.example"},
+		{Config{ServeTransit: ":4001", OIDCRedirectURL: "https://wormhole.example/auth/callback"}, "wormhole.example"},
+		{Config{ServeTransit: "10.0.0.5:4001"}, "10.0.0.5"},
+		{Config{ServeTransit: "0.0.0.0:4001"}, ""},
+		{Config{ServeTransit: ":4001"}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.transitAdvertiseHost(); got != tt.want {
+			t.Errorf("transitAdvertiseHost(%+v) = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
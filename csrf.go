@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfCookie = "wormhole_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// originAllowed reports whether a browser request comes from a page we
+// trust: the server's own origin or one of the configured allowed origins.
+// Requests without an Origin header come from non-browser clients.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.config.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCSRFToken returns a random token signed with the server secret, so a
+// cookie planted by a sibling domain is not accepted.
+func (s *Server) newCSRFToken() string {
+	nonce := randomToken()
+	return nonce + "." + s.csrfMAC(nonce)
+}
+
+func (s *Server) csrfMAC(nonce string) string {
+	return base64.RawURLEncoding.EncodeToString(valueMAC(s.secret, csrfCookie, nonce))
+}
+
+func (s *Server) validCSRFToken(token string) bool {
+	nonce, mac, ok := strings.Cut(token, ".")
+	return ok && hmac.Equal([]byte(mac), []byte(s.csrfMAC(nonce)))
+}
+
+// handleCSRF serves GET /api/csrf: it sets the CSRF cookie and returns the
+// same token, which must be echoed in the X-CSRF-Token header.
+func (s *Server) handleCSRF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := s.newCSRFToken()
+	if cookie, err := r.Cookie(csrfCookie); err == nil && s.validCSRFToken(cookie.Value) {
+		token = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/api/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// requireCSRF protects handlers that start transfers. The browser must
+// come from an allowed origin and echo the CSRF cookie in a header, which
+// a cross-site form or fetch cannot do. Clients authenticated with an API
+// token carry no ambient credentials and are exempt.
+func (s *Server) requireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id := identityFrom(r.Context()); id != nil && id.Method == "token" {
+			next(w, r)
+			return
+		}
+
+		if !s.originAllowed(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookie)
+		header := r.Header.Get(csrfHeader)
+		if err != nil || header == "" || !hmac.Equal([]byte(header), []byte(cookie.Value)) || !s.validCSRFToken(header) {
+			http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	server := NewServer(Config{AllowedOrigins: []string{"https://wormhole.example.com"}})
+
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"no origin", "", true},
+		{"same origin", "http://example.com", true},
+		{"configured origin", "https://wormhole.example.com", true},
+		{"other site", "https://evil.example", false},
+		{"scheme mismatch on configured origin", "http://wormhole.example.com", false},
+		{"lookalike host", "http://example.com.evil.example", false},
+		{"null origin", "null", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := server.originAllowed(req); got != tt.want {
+				t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketRejectsForeignOrigin(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "waiting", CreatedAt: time.Now()})
+
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws?id=" + testSendID
+	header := http.Header{
+		"Authorization": {"Bearer " + server.capability(testSendID)},
+		"Origin":        {"https://evil.example"},
+	}
+	if conn, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil {
+		conn.Close()
+		t.Fatal("WebSocket from a foreign origin should be refused")
+	} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Dial error = %v, want 403", err)
+	}
+
+	header.Set("Origin", ts.URL)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("same-origin Dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRequireCSRF(t *testing.T) {
+	server := NewServer(Config{})
+	handler := server.requireCSRF(func(w http.ResponseWriter, r *http.Request) {})
+
+	// Fetch a token the way the frontend does
+	w := httptest.NewRecorder()
+	server.handleCSRF(w, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+	var resp struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Value != resp.Token {
+		t.Fatalf("cookies = %+v, token = %q", cookies, resp.Token)
+	}
+	forged := "nonce." + strings.Repeat("A", 43)
+
+	tests := []struct {
+		name     string
+		cookie   string
+		header   string
+		origin   string
+		identity *Identity
+		want     int
+	}{
+		{"valid", resp.Token, resp.Token, "", nil, http.StatusOK},
+		{"valid same origin", resp.Token, resp.Token, "http://example.com", nil, http.StatusOK},
+		{"no token", "", "", "", nil, http.StatusForbidden},
+		{"cookie only", resp.Token, "", "", nil, http.StatusForbidden},
+		{"header mismatch", resp.Token, server.newCSRFToken(), "", nil, http.StatusForbidden},
+		{"unsigned token", forged, forged, "", nil, http.StatusForbidden},
+		{"foreign origin", resp.Token, resp.Token, "https://evil.example", nil, http.StatusForbidden},
+		{"api token client", "", "", "", &Identity{Name: "ci", Method: "token"}, http.StatusOK},
+		{"basic auth client", "", "", "", &Identity{Name: "alice", Method: "basic"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/api/receive", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeader, tt.header)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.identity != nil {
+				req = req.WithContext(withIdentity(context.Background(), tt.identity))
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleCSRFKeepsValidCookie(t *testing.T) {
+	server := NewServer(Config{})
+	token := server.newCSRFToken()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/csrf", nil)
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	w := httptest.NewRecorder()
+	server.handleCSRF(w, req)
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Token != token {
+		t.Errorf("token = %q, want the existing %q", resp.Token, token)
+	}
+}
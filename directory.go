@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileEntry describes one file inside a received directory.
+type FileEntry struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	DownloadPath string `json:"downloadPath"`
+}
+
+// directoryArchiveName is the on-disk name of a received directory's zip.
+func directoryArchiveName(dirName string) string {
+	return dirName + ".zip"
+}
+
+// cleanEntryPath normalises a zip entry name, rejecting names that would
+// escape the directory when unpacked.
+func cleanEntryPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	cleaned := path.Clean("/" + name)[1:]
+	if cleaned == "" || cleaned != strings.TrimSuffix(name, "/") {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// listDirectoryArchive reads the zip's central directory without
+// extracting anything.
+func listDirectoryArchive(zipPath, transferID, dirName string) ([]FileEntry, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make([]FileEntry, 0, len(zr.File))
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name, ok := cleanEntryPath(f.Name)
+		if !ok {
+			return nil, fmt.Errorf("unsafe path in archive: %q", f.Name)
+		}
+		files = append(files, FileEntry{
+			Path:         name,
+			Size:         int64(f.UncompressedSize64),
+			DownloadPath: fmt.Sprintf("/api/download/%s/%s/%s", transferID, dirName, name),
+		})
+	}
+	return files, nil
+}
+
+// serveDirectoryDownload handles the extra download forms of a received
+// directory: "{dir}.tar.gz" re-packs the archive, "{dir}/{entry}" serves a
+// single file out of it. It reports false if the path is neither.
+func (s *Server) serveDirectoryDownload(w http.ResponseWriter, r *http.Request, transfer *TransferStatus, name string) bool {
+	dirName := transfer.Filename
+	zipPath := filepath.Join(s.tempDir, transfer.ID, directoryArchiveName(dirName))
+
+	switch {
+	case name == dirName+".tar.gz":
+		zr, err := zip.OpenReader(zipPath)
+		if err != nil {
+			http.Error(w, "Archive not found", http.StatusNotFound)
+			return true
+		}
+		defer zr.Close()
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		writeTarGz(w, dirName, zr.File)
+		return true
+
+	case strings.HasPrefix(name, dirName+"/"):
+		entryName := strings.TrimPrefix(name, dirName+"/")
+
+		zr, err := zip.OpenReader(zipPath)
+		if err != nil {
+			http.Error(w, "Archive not found", http.StatusNotFound)
+			return true
+		}
+		defer zr.Close()
+
+		// Entries are looked up by name, never joined onto a disk path
+		for _, f := range zr.File {
+			if cleaned, ok := cleanEntryPath(f.Name); !ok || cleaned != entryName || f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				http.Error(w, "Failed to read archive", http.StatusInternalServerError)
+				return true
+			}
+			defer rc.Close()
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(entryName)}))
+			w.Header().Set("Content-Length", fmt.Sprint(f.UncompressedSize64))
+			io.Copy(w, rc)
+			return true
+		}
+		http.Error(w, "File not found", http.StatusNotFound)
+		return true
+	}
+
+	return false
+}
+
+// writeTarGz streams the zip entries as a gzipped tarball rooted at dirName.
+func writeTarGz(w io.Writer, dirName string, files []*zip.File) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		name, ok := cleanEntryPath(f.Name)
+		if !ok || f.FileInfo().IsDir() {
+			continue
+		}
+
+		hdr := &tar.Header{
+			Name:    dirName + "/" + name,
+			Mode:    0644,
+			Size:    int64(f.UncompressedSize64),
+			ModTime: f.Modified,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func TestCleanEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"sub/b.txt", "sub/b.txt", true},
+		{"sub\\c.txt", "sub/c.txt", true},
+		{"dir/", "dir", true},
+		{"../evil", "", false},
+		{"/etc/passwd", "", false},
+		{"a/../../b", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := cleanEntryPath(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanEntryPath(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// writeTestZip writes a zip with the given entries to path.
+func writeTestZip(t *testing.T, path string, entries map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zw := zip.NewWriter(f)
+	for _, name := range names {
+		w, _ := zw.Create(name)
+		w.Write([]byte(entries[name]))
+	}
+	zw.Close()
+}
+
+func TestListDirectoryArchive(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "album.zip")
+	writeTestZip(t, zipPath, map[string]string{"a.txt": "aaa", "sub/b.txt": "bb"})
+
+	files, err := listDirectoryArchive(zipPath, "recv-1", "album")
+	if err != nil {
+		t.Fatalf("listDirectoryArchive: %v", err)
+	}
+	want := []FileEntry{
+		{Path: "a.txt", Size: 3, DownloadPath: "/api/download/recv-1/album/a.txt"},
+		{Path: "sub/b.txt", Size: 2, DownloadPath: "/api/download/recv-1/album/sub/b.txt"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("files = %+v, want %+v", files, want)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("files[%d] = %+v, want %+v", i, files[i], want[i])
+		}
+	}
+
+	// Archives with escaping paths are refused
+	writeTestZip(t, zipPath, map[string]string{"../escape.txt": "x"})
+	if _, err := listDirectoryArchive(zipPath, "recv-1", "album"); err == nil {
+		t.Error("listDirectoryArchive should reject path traversal entries")
+	}
+}
+
+// newDirectoryTransfer registers a completed directory receive backed by
+// a zip in the server's temp dir.
+func newDirectoryTransfer(t *testing.T, server *Server) {
+	t.Helper()
+	server.tempDir = t.TempDir()
+	os.MkdirAll(filepath.Join(server.tempDir, testRecvID), 0755)
+	writeTestZip(t, filepath.Join(server.tempDir, testRecvID, "album.zip"), map[string]string{
+		"a.txt":     "first",
+		"sub/b.txt": "second",
+	})
+	server.setTransfer(&TransferStatus{
+		ID:          testRecvID,
+		Type:        "receive",
+		Status:      "complete",
+		Filename:    "album",
+		ContentType: "directory",
+		CreatedAt:   time.Now(),
+	})
+}
+
+func TestDownloadDirectoryEntry(t *testing.T) {
+	server := NewServer(Config{})
+	newDirectoryTransfer(t, server)
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/api/download/" + testRecvID + "/album/sub/b.txt", http.StatusOK, "second"},
+		{"/api/download/" + testRecvID + "/album/a.txt", http.StatusOK, "first"},
+		{"/api/download/" + testRecvID + "/album/missing.txt", http.StatusNotFound, ""},
+		{"/api/download/" + testRecvID + "/album/../album.zip", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		req := withCapability(server, httptest.NewRequest(http.MethodGet, tt.path, nil), testRecvID)
+		w := httptest.NewRecorder()
+
+		server.handleDownload(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("GET %s: got status %d, want %d", tt.path, w.Code, tt.code)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("GET %s: body = %q, want %q", tt.path, w.Body.String(), tt.body)
+		}
+	}
+
+	// The whole archive is still served as-is
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/download/"+testRecvID+"/album.zip", nil), testRecvID)
+	w := httptest.NewRecorder()
+	server.handleDownload(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET album.zip: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestDownloadDirectoryTarGz(t *testing.T) {
+	server := NewServer(Config{})
+	newDirectoryTransfer(t, server)
+
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/download/"+testRecvID+"/album.tar.gz", nil), testRecvID)
+	w := httptest.NewRecorder()
+
+	server.handleDownload(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET album.tar.gz: got status %d", w.Code)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	got := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		got[hdr.Name] = string(data)
+	}
+
+	if got["album/a.txt"] != "first" || got["album/sub/b.txt"] != "second" || len(got) != 2 {
+		t.Errorf("tarball contents = %v", got)
+	}
+}
+
+func TestReceiveDirectory(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	sender := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	entries := []wormhole.DirectoryEntry{
+		{Path: "album/a.txt", Mode: 0644, Reader: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("first")), nil
+		}},
+		{Path: "album/sub/b.txt", Mode: 0644, Reader: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("second")), nil
+		}},
+	}
+	code, _, err := sender.SendDirectory(context.Background(), "album", entries)
+	if err != nil {
+		t.Fatalf("SendDirectory: %v", err)
+	}
+
+	id := startReceive(t, server, code)
+	offer := waitForStatus(t, server, id, "offered")
+	if offer.ContentType != "directory" || offer.FileCount != 2 {
+		t.Errorf("offer = %s with %d files, want directory with 2", offer.ContentType, offer.FileCount)
+	}
+	server.decideTransfer(id, true)
+
+	done := waitForStatus(t, server, id, "complete")
+	if done.DownloadPath != "/api/download/"+id+"/album.zip" {
+		t.Errorf("DownloadPath = %q", done.DownloadPath)
+	}
+	if len(done.Files) != 2 || done.Files[1].Path != "sub/b.txt" {
+		t.Fatalf("Files = %+v", done.Files)
+	}
+
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, done.Files[1].DownloadPath, nil), id)
+	w := httptest.NewRecorder()
+	server.handleDownload(w, req)
+	if !bytes.Equal(w.Body.Bytes(), []byte("second")) {
+		t.Errorf("entry download = %q, want %q", w.Body.String(), "second")
+	}
+}
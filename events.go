@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+)
+
+// subscriberQueueSize is how many messages a subscriber may fall behind
+// before it is evicted.
+const subscriberQueueSize = 64
+
+// eventBus fans transfer status snapshots out to subscribers. Publishing
+// never blocks: each subscriber has its own buffered queue, drained by a
+// single writer, and a subscriber whose queue is full is evicted rather
+// than allowed to hold up the transfer.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[string]map[*subscriber]struct{} // by transfer ID
+}
+
+// event is one message on the bus: an encoded transfer snapshot with its
+// version, or a server-wide notice with version zero.
+type event struct {
+	version int64
+	data    []byte
+}
+
+// subscriber is one consumer of a transfer's events. Its queue delivers
+// messages in the order they were published; done is closed when the
+// subscription ends, and evicted then tells whether it fell behind.
+type subscriber struct {
+	queue   chan event
+	done    chan struct{}
+	evicted bool
+	once    sync.Once
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[string]map[*subscriber]struct{})}
+}
+
+func (sub *subscriber) close(evicted bool) {
+	sub.once.Do(func() {
+		sub.evicted = evicted
+		close(sub.done)
+	})
+}
+
+// subscribe registers a subscriber for transfer id.
+func (b *eventBus) subscribe(id string) *subscriber {
+	sub := &subscriber{
+		queue: make(chan event, subscriberQueueSize),
+		done:  make(chan struct{}),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[id] == nil {
+		b.subs[id] = make(map[*subscriber]struct{})
+	}
+	b.subs[id][sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe removes sub and closes its Done channel.
+func (b *eventBus) unsubscribe(id string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(id, sub)
+	sub.close(false)
+}
+
+func (b *eventBus) remove(id string, sub *subscriber) {
+	delete(b.subs[id], sub)
+	if len(b.subs[id]) == 0 {
+		delete(b.subs, id)
+	}
+}
+
+// hasSubscribers reports whether anyone listens to transfer id, so callers
+// can skip encoding messages nobody will read.
+func (b *eventBus) hasSubscribers(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs[id]) > 0
+}
+
+// publish queues ev for every subscriber of transfer id.
+func (b *eventBus) publish(id string, ev event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[id] {
+		b.send(id, sub, ev)
+	}
+}
+
+// broadcast queues msg for every subscriber of every transfer.
+func (b *eventBus) broadcast(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, subs := range b.subs {
+		for sub := range subs {
+			b.send(id, sub, event{data: msg})
+		}
+	}
+}
+
+// send queues ev for sub, evicting it if its queue is full. b.mu must be
+// held.
+func (b *eventBus) send(id string, sub *subscriber, ev event) {
+	select {
+	case sub.queue <- ev:
+	default:
+		b.remove(id, sub)
+		sub.close(true)
+	}
+}
+
+// closeAll ends every subscription, so that event streams and long polls
+// return when the server shuts down.
+func (b *eventBus) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subs := range b.subs {
+		for sub := range subs {
+			sub.close(false)
+		}
+	}
+	b.subs = make(map[string]map[*subscriber]struct{})
+}
+
+// count is the number of active subscribers.
+func (b *eventBus) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, subs := range b.subs {
+		n += len(subs)
+	}
+	return n
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventBusOrder(t *testing.T) {
+	bus := newEventBus()
+	sub := bus.subscribe(testSendID)
+	other := bus.subscribe(testRecvID)
+
+	for i := 0; i < 10; i++ {
+		bus.publish(testSendID, event{version: int64(i), data: []byte(fmt.Sprint(i))})
+	}
+	for i := 0; i < 10; i++ {
+		if got := string((<-sub.queue).data); got != fmt.Sprint(i) {
+			t.Fatalf("message %d = %q", i, got)
+		}
+	}
+	if len(other.queue) != 0 {
+		t.Error("publish reached a subscriber of another transfer")
+	}
+
+	bus.broadcast([]byte("all"))
+	if string((<-sub.queue).data) != "all" || string((<-other.queue).data) != "all" {
+		t.Error("broadcast should reach every subscriber")
+	}
+
+	if n := bus.count(); n != 2 {
+		t.Errorf("count = %d, want 2", n)
+	}
+	bus.unsubscribe(testSendID, sub)
+	bus.unsubscribe(testSendID, sub) // twice is harmless
+	if bus.hasSubscribers(testSendID) {
+		t.Error("hasSubscribers after unsubscribe")
+	}
+	select {
+	case <-sub.done:
+	default:
+		t.Error("unsubscribe should close done")
+	}
+	if sub.evicted {
+		t.Error("unsubscribed subscriber marked as evicted")
+	}
+}
+
+func TestEventBusEvictsSlowSubscriber(t *testing.T) {
+	bus := newEventBus()
+	slow := bus.subscribe(testSendID)
+	fast := bus.subscribe(testSendID)
+
+	for i := 0; i <= subscriberQueueSize; i++ {
+		bus.publish(testSendID, event{version: int64(i), data: []byte(fmt.Sprint(i))})
+		<-fast.queue
+	}
+
+	select {
+	case <-slow.done:
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber was not evicted")
+	}
+	if !slow.evicted {
+		t.Error("evicted = false")
+	}
+	if n := bus.count(); n != 1 {
+		t.Errorf("count = %d, want 1", n)
+	}
+
+	// Closing an evicted subscriber keeps the reason
+	bus.unsubscribe(testSendID, slow)
+	if !slow.evicted {
+		t.Error("unsubscribe cleared evicted")
+	}
+}
+
+func TestWebSocketSlowSubscriberClosed(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "sending", CreatedAt: time.Now()})
+
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws?id=" + testSendID
+	header := http.Header{"Authorization": {"Bearer " + server.capability(testSendID)}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return server.events.count() == 1 })
+
+	// Nobody reads, so the writer blocks on the socket and the queue fills
+	payload := strings.Repeat("x", 64<<10)
+	for i := 0; i < 1000 && server.events.count() > 0; i++ {
+		server.events.publish(testSendID, event{data: []byte(payload)})
+		time.Sleep(time.Millisecond)
+	}
+	if n := server.events.count(); n != 0 {
+		t.Fatalf("subscriber not evicted, count = %d", n)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("ReadMessage error = %v, want policy violation close", err)
+		}
+		break
+	}
+}
+
+// TestConcurrentTransferUpdates hammers one transfer from every side at
+// once. Run it with -race.
+func TestConcurrentTransferUpdates(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+	_, cancel := context.WithCancel(context.Background())
+	server.setTransfer(&TransferStatus{
+		ID:        testSendID,
+		Type:      "send",
+		Status:    "sending",
+		Total:     1000,
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws?id=" + testSendID
+	header := http.Header{"Authorization": {"Bearer " + server.capability(testSendID)}}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Progress updates
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := int64(0); n < 1000; n++ {
+				server.updateTransfer(testSendID, func(t *TransferStatus) {
+					t.Transferred = n
+					t.Progress = float64(n) * 100 / float64(t.Total)
+				})
+			}
+		}()
+	}
+
+	// Subscribers coming and going
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sub := server.subscribe(testSendID)
+				<-sub.queue
+				server.events.unsubscribe(testSendID, sub)
+			}
+		}()
+	}
+
+	// Status reads
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 200; j++ {
+			req := httptest.NewRequest(http.MethodGet, "/api/status?id="+testSendID, nil)
+			req.Header = header
+			rec := httptest.NewRecorder()
+			server.handleStatus(rec, req)
+			var status TransferStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+				t.Errorf("status body: %v", err)
+				return
+			}
+		}
+	}()
+
+	// WebSocket clients reading until the transfer finishes
+	var clients sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+			for {
+				var status TransferStatus
+				if err := conn.ReadJSON(&status); err != nil {
+					return
+				}
+				if status.finished() {
+					return
+				}
+			}
+		}()
+	}
+
+	// Metrics scrapes
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			server.handleMetrics(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := server.cancelTransfer(testSendID); err != nil {
+		t.Fatalf("cancelTransfer: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	clients.Wait()
+
+	if got := server.getTransfer(testSendID).Status; got != "cancelled" {
+		t.Errorf("Status = %q, want cancelled", got)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package main
+
+// freeSpace is only implemented where syscall.Statfs is uniform; elsewhere
+// the free space check is skipped.
+func freeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -5,11 +5,11 @@ go 1.21
 require (
 	github.com/gorilla/websocket v1.5.1
 	github.com/psanford/wormhole-william v1.0.7
+	golang.org/x/crypto v0.14.0
 )
 
 require (
 	github.com/klauspost/compress v1.15.0 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	nhooyr.io/websocket v1.8.7 // indirect
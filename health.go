@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+var errFreeSpaceUnsupported = errors.New("free space check not supported on this platform")
+
+const (
+	rendezvousCheckTimeout = 5 * time.Second
+	// rendezvousCheckTTL keeps frequent probes from hammering the mailbox
+	rendezvousCheckTTL = 30 * time.Second
+)
+
+// handleHealthz serves GET /healthz: the process is up and serving.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz serves GET /readyz: the server can take new transfers. It
+// reports every check and answers 503 if any of them failed.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	if s.shuttingDown.Load() {
+		check("shutdown", fmt.Errorf("server is shutting down"))
+	}
+	check("tempDir", s.checkTempDir())
+	if s.config.ReadyCheckRendezvous {
+		check("rendezvous", s.rendezvousCheck.check(r.Context(), s.rendezvousURL()))
+	}
+
+	resp := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{Status: "ok", Checks: checks}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		resp.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkTempDir makes sure uploads and receives can be written to tempDir
+// and that it has at least MinFreeSpace bytes left.
+func (s *Server) checkTempDir() error {
+	f, err := os.CreateTemp(s.tempDir, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if min := s.config.MinFreeSpace; min > 0 {
+		free, err := freeSpace(s.tempDir)
+		if errors.Is(err, errFreeSpaceUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read free space: %w", err)
+		}
+		if free < min {
+			return fmt.Errorf("only %d MiB free, want %d MiB", free>>20, min>>20)
+		}
+	}
+	return nil
+}
+
+func (s *Server) rendezvousURL() string {
+	if s.config.RendezvousURL != "" {
+		return s.config.RendezvousURL
+	}
+	return wormhole.DefaultRendezvousURL
+}
+
+// rendezvousCheck remembers the outcome of the last mailbox probe.
+// Concurrent checks share one probe, which runs without holding mu.
+type rendezvousCheck struct {
+	mu       sync.Mutex
+	checked  time.Time
+	err      error
+	inflight chan struct{} // closed when the running probe is done
+}
+
+// check opens a WebSocket to the rendezvous server, reusing a recent
+// result if there is one. A caller giving up only stops waiting; the probe
+// finishes on its own timeout, so a cancellation is never cached.
+func (c *rendezvousCheck) check(ctx context.Context, url string) error {
+	c.mu.Lock()
+	if time.Since(c.checked) < rendezvousCheckTTL {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	done := c.inflight
+	if done == nil {
+		done = make(chan struct{})
+		c.inflight = done
+		go c.probe(url, done)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *rendezvousCheck) probe(url string, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), rendezvousCheckTimeout)
+	defer cancel()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err == nil {
+		conn.Close()
+	} else {
+		err = fmt.Errorf("unreachable: %w", err)
+	}
+
+	c.mu.Lock()
+	c.checked, c.err, c.inflight = time.Now(), err, nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// handleVersion serves GET /api/version with the build info embedded by
+// the Go toolchain.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Version   string `json:"version"`
+		GoVersion string `json:"goVersion"`
+		Revision  string `json:"revision,omitempty"`
+		Time      string `json:"time,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+		Wormhole  string `json:"wormholeWilliam,omitempty"`
+	}{Version: "unknown"}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		resp.Version = info.Main.Version
+		resp.GoVersion = info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				resp.Revision = setting.Value
+			case "vcs.time":
+				resp.Time = setting.Value
+			case "vcs.modified":
+				resp.Modified = setting.Value == "true"
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/psanford/wormhole-william" {
+				resp.Wormhole = dep.Version
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func readyz(t *testing.T, server *Server) (int, map[string]string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return w.Code, resp.Checks
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewServer(Config{}).handleHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("handleHealthz: got status %d", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	server := NewServer(Config{MinFreeSpace: 1})
+	server.tempDir = t.TempDir()
+
+	if code, checks := readyz(t, server); code != http.StatusOK || checks["tempDir"] != "ok" {
+		t.Errorf("readyz = %d %v, want ready", code, checks)
+	}
+
+	server.shuttingDown.Store(true)
+	if code, checks := readyz(t, server); code != http.StatusServiceUnavailable || checks["shutdown"] == "ok" {
+		t.Errorf("readyz during shutdown = %d %v, want unavailable", code, checks)
+	}
+}
+
+func TestReadyzTempDir(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = filepath.Join(t.TempDir(), "missing")
+	if code, _ := readyz(t, server); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz with missing temp dir = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	// No disk is this large
+	server = NewServer(Config{MinFreeSpace: 1 << 62})
+	server.tempDir = t.TempDir()
+	if code, checks := readyz(t, server); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz without free space = %d %v, want %d", code, checks, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReadyzRendezvous(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	cfg.ReadyCheckRendezvous = true
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+	if code, checks := readyz(t, server); code != http.StatusOK || checks["rendezvous"] != "ok" {
+		t.Errorf("readyz = %d %v, want ready", code, checks)
+	}
+
+	server = NewServer(Config{RendezvousURL: "ws://127.0.0.1:1/v1", ReadyCheckRendezvous: true})
+	server.tempDir = t.TempDir()
+	if code, checks := readyz(t, server); code != http.StatusServiceUnavailable || checks["rendezvous"] == "ok" {
+		t.Errorf("readyz with unreachable mailbox = %d %v, want unavailable", code, checks)
+	}
+}
+
+func TestRendezvousCheckCancelled(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	var c rendezvousCheck
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.check(ctx, cfg.RendezvousURL); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled check = %v, want context.Canceled", err)
+	}
+	// The probe itself still completes and is what gets cached
+	if err := c.check(context.Background(), cfg.RendezvousURL); err != nil {
+		t.Errorf("check after cancelled one = %v", err)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewServer(Config{}).handleVersion(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleVersion: got status %d", w.Code)
+	}
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp["version"] == "" || resp["goVersion"] == "" {
+		t.Errorf("version = %v", resp)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter hands out a token bucket per client. Buckets refill at rate
+// tokens per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it
+// reports how long until the next token.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune forgets buckets that have refilled completely; they are
+// indistinguishable from new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// transferSlots caps how many transfers move data at once. Transfers
+// beyond the cap wait in the "queued" status, and those beyond the queue
+// are turned away.
+type transferSlots struct {
+	slots     chan struct{}
+	maxQueued int64
+	queued    atomic.Int64
+}
+
+func newTransferSlots(maxActive, maxQueued int) *transferSlots {
+	if maxActive <= 0 {
+		return nil
+	}
+	return &transferSlots{
+		slots:     make(chan struct{}, maxActive),
+		maxQueued: int64(maxQueued),
+	}
+}
+
+// queueFull reports whether a new transfer would have nowhere to wait.
+func (t *transferSlots) queueFull() bool {
+	return len(t.slots) == cap(t.slots) && t.queued.Load() >= t.maxQueued
+}
+
+// limitStats are the counters behind the rate limiting metrics.
+type limitStats struct {
+	rateLimited atomic.Int64 // requests refused by the rate limiter
+	queueFull   atomic.Int64 // requests refused because the queue was full
+}
+
+// clientKey identifies who a request counts against: the authenticated
+// user if there is one, otherwise the client address.
+func (s *Server) clientKey(r *http.Request) string {
+	if name := ownerOf(r); name != "" {
+		return "user:" + name
+	}
+	return "ip:" + s.clientIP(r)
+}
+
+// clientIP is the request's remote address, or the address a trusted
+// reverse proxy forwarded for.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !ipInNets(host, s.trustedProxies) {
+		return host
+	}
+
+	// Walk X-Forwarded-For from the nearest hop, skipping our own proxies
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !ipInNets(hop, s.trustedProxies) {
+			return hop
+		}
+	}
+	return host
+}
+
+func ipInNets(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitTransfers guards the handlers that start transfers: it applies the
+// per-client rate limit and refuses work when the queue is full or the
+// server is shutting down.
+func (s *Server) limitTransfers(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.shuttingDown.Load() {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if s.limiter != nil {
+			if ok, wait := s.limiter.allow(s.clientKey(r), time.Now()); !ok {
+				s.limitStats.rateLimited.Add(1)
+				tooManyRequests(w, wait, "Too many transfers, please slow down")
+				return
+			}
+		}
+		if s.slots != nil && s.slots.queueFull() {
+			s.limitStats.queueFull.Add(1)
+			tooManyRequests(w, 30*time.Second, "Server is busy, please try again later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+var errQueueFull = errors.New("too many transfers waiting for a free slot")
+
+// enqueue takes a place in the queue unless it is full.
+func (t *transferSlots) enqueue() bool {
+	for {
+		n := t.queued.Load()
+		if n >= t.maxQueued {
+			return false
+		}
+		if t.queued.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// acquireSlot blocks until the transfer may start moving data, parking it
+// in the "queued" status meanwhile; the caller then sets the status it
+// moves on to. The returned func gives the slot back.
+func (s *Server) acquireSlot(ctx context.Context, id string) (func(), error) {
+	if s.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.slots.slots }
+
+	select {
+	case s.slots.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if !s.slots.enqueue() {
+		s.limitStats.queueFull.Add(1)
+		return nil, errQueueFull
+	}
+	defer s.slots.queued.Add(-1)
+
+	s.updateTransfer(id, func(t *TransferStatus) {
+		t.Status = "queued"
+	})
+
+	select {
+	case s.slots.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		// Cancelled just as the slot freed up
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// lazySlot takes a transfer slot the first time a send moves data, so
+// that codes waiting for their receiver hold none.
+type lazySlot struct {
+	mu      sync.Mutex
+	taken   bool
+	release func()
+	err     error
+}
+
+func (l *lazySlot) acquire(ctx context.Context, s *Server, id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.taken {
+		l.taken = true
+		l.release, l.err = s.acquireSlot(ctx, id)
+	}
+	return l.err
+}
+
+// done gives the slot back, if one was taken.
+func (l *lazySlot) done() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.release != nil {
+		l.release()
+		l.release = nil
+	}
+}
+
+// handleLimits serves GET /api/limits: the configured limits and how often
+// they have been hit. Admins only.
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		RateLimit          int   `json:"rateLimit"`
+		RateBurst          int   `json:"rateBurst"`
+		MaxActiveTransfers int   `json:"maxActiveTransfers"`
+		MaxQueuedTransfers int   `json:"maxQueuedTransfers"`
+		Active             int   `json:"active"`
+		Queued             int64 `json:"queued"`
+		RateLimited        int64 `json:"rateLimited"`
+		QueueFull          int64 `json:"queueFull"`
+	}{
+		RateLimit:          s.config.RateLimit,
+		RateBurst:          s.config.RateBurst,
+		MaxActiveTransfers: s.config.MaxActiveTransfers,
+		MaxQueuedTransfers: s.config.MaxQueuedTransfers,
+		RateLimited:        s.limitStats.rateLimited.Load(),
+		QueueFull:          s.limitStats.queueFull.Load(),
+	}
+	if s.slots != nil {
+		resp.Active = len(s.slots.slots)
+		resp.Queued = s.slots.queued.Load()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
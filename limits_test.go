@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 2) // one token per second
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst refused", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("request beyond burst allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %v, want up to 1s", wait)
+	}
+
+	// Other clients have their own bucket
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("second client refused")
+	}
+
+	// The bucket refills over time
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("request after refill refused")
+	}
+
+	l.prune(now.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Errorf("prune left %d full buckets", len(l.buckets))
+	}
+
+	if newRateLimiter(0, 10) != nil {
+		t.Error("a zero rate should disable the limiter")
+	}
+}
+
+func TestLimitTransfersRateLimit(t *testing.T) {
+	server := NewServer(Config{RateLimit: 1, RateBurst: 1})
+	handler := server.limitTransfers(func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/receive", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := request("192.0.2.1:1000"); w.Code != http.StatusOK {
+		t.Fatalf("first request: got status %d", w.Code)
+	}
+	w := request("192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want %q", got, "60")
+	}
+	if w := request("192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("other client: got status %d", w.Code)
+	}
+	if got := server.limitStats.rateLimited.Load(); got != 1 {
+		t.Errorf("rateLimited = %d, want 1", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	server := NewServer(Config{TrustedProxies: []string{"10.0.0.0/8"}})
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		want   string
+	}{
+		{"direct", "192.0.2.1:1000", "", "192.0.2.1"},
+		{"spoofed header from untrusted peer", "192.0.2.1:1000", "198.51.100.7", "192.0.2.1"},
+		{"via trusted proxy", "10.0.0.2:1000", "198.51.100.7", "198.51.100.7"},
+		{"via proxy chain", "10.0.0.2:1000", "203.0.113.5, 198.51.100.7, 10.0.0.3", "198.51.100.7"},
+		{"proxy without header", "10.0.0.2:1000", "", "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := server.clientIP(req); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferQueue(t *testing.T) {
+	server := NewServer(Config{MaxActiveTransfers: 1, MaxQueuedTransfers: 1})
+	third := newTransferID("recv")
+	for _, id := range []string{testSendID, testRecvID, third} {
+		server.setTransfer(&TransferStatus{ID: id, Type: "receive", Status: "offered", CreatedAt: time.Now()})
+	}
+	ctx := context.Background()
+
+	release, err := server.acquireSlot(ctx, testSendID)
+	if err != nil {
+		t.Fatalf("acquireSlot: %v", err)
+	}
+
+	queued := make(chan func())
+	go func() {
+		release, err := server.acquireSlot(ctx, testRecvID)
+		if err != nil {
+			t.Errorf("queued acquireSlot: %v", err)
+		}
+		queued <- release
+	}()
+	waitForStatus(t, server, testRecvID, "queued")
+
+	// Both the slot and the queue are taken
+	if _, err := server.acquireSlot(ctx, third); err != errQueueFull {
+		t.Errorf("third acquireSlot = %v, want %v", err, errQueueFull)
+	}
+	handler := server.limitTransfers(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/api/receive", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("new transfer: got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Freeing the slot lets the queued transfer run
+	release()
+	(<-queued)()
+	if n := len(server.slots.slots); n != 0 {
+		t.Errorf("%d slots still held", n)
+	}
+}
+
+func TestCancelQueuedTransfer(t *testing.T) {
+	server := NewServer(Config{MaxActiveTransfers: 1, MaxQueuedTransfers: 5})
+	for _, id := range []string{testSendID, testRecvID} {
+		server.setTransfer(&TransferStatus{ID: id, Type: "receive", Status: "offered", CreatedAt: time.Now()})
+	}
+
+	release, err := server.acquireSlot(context.Background(), testSendID)
+	if err != nil {
+		t.Fatalf("acquireSlot: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := server.acquireSlot(ctx, testRecvID)
+		errc <- err
+	}()
+	waitForStatus(t, server, testRecvID, "queued")
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("cancelled acquireSlot = %v", err)
+	}
+
+	// The cancelled transfer must not take the freed slot
+	release()
+	if n := len(server.slots.slots); n != 0 {
+		t.Errorf("%d slots still held", n)
+	}
+	if n := server.slots.queued.Load(); n != 0 {
+		t.Errorf("%d transfers still queued", n)
+	}
+}
+
+func TestWaitingSendHoldsNoSlot(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	cfg.MaxActiveTransfers = 1
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	content := []byte("hello")
+	var codes []string
+	for i := 0; i < 2; i++ {
+		body, contentType := multipartBody(t, "file", map[string][]byte{"a.txt": content})
+		id := startSend(t, server, body, contentType)
+		codes = append(codes, waitForStatus(t, server, id, "waiting").Code)
+	}
+	if n := len(server.slots.slots); n != 0 {
+		t.Fatalf("%d slots held by sends without a receiver", n)
+	}
+
+	receiver := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	msg, err := receiver.Receive(context.Background(), codes[0])
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if data, _ := io.ReadAll(msg); string(data) != string(content) {
+		t.Errorf("received %q", data)
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	server := NewServer(Config{RateLimit: 1, RateBurst: 1, MaxActiveTransfers: 3})
+	server.limitStats.rateLimited.Add(2)
+
+	w := httptest.NewRecorder()
+	server.handleLimits(w, httptest.NewRequest(http.MethodGet, "/api/limits", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleLimits: got status %d", w.Code)
+	}
+
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp["rateLimited"] != float64(2) || resp["maxActiveTransfers"] != float64(3) || resp["active"] != float64(0) {
+		t.Errorf("unexpected limits: %v", resp)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// newLogger builds the server's logger. format is "text" or "json".
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q: want text or json", format)
+}
+
+// fatal logs msg and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// loggerFrom returns the request-scoped logger in ctx, or the default one.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// Incoming request IDs are passed through only if they look harmless
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags every request with an ID, taken from X-Request-ID
+// when a proxy already set one, echoes it back, and logs the request once
+// it has been served. Handlers log through loggerFrom to carry the ID.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = hex.EncodeToString(newSecret()[:8])
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
+
+		logger.Debug("Request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.written,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// statusRecorder remembers the status code and body size of a response.
+// It passes Hijack and Flush through for WebSockets and streaming.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// transferLogger is the logger for a transfer created by r.
+func transferLogger(r *http.Request, id string) *slog.Logger {
+	return loggerFrom(r.Context()).With("transfer", id)
+}
+
+// logger returns the transfer's logger. Transfers restored from the
+// journal have none and log with the default one.
+func (t *TransferStatus) logger() *slog.Logger {
+	if t.log == nil {
+		return slog.Default().With("transfer", t.ID)
+	}
+	return t.log
+}
+
+// logTransition logs a transfer's move from prev, nil for a new transfer,
+// to next, with the time spent in the previous status and the bytes moved.
+func logTransition(prev, next *TransferStatus) {
+	since := next.CreatedAt
+	var previous string
+	if prev != nil {
+		previous = prev.Status
+		if !prev.statusSince.IsZero() {
+			since = prev.statusSince
+		}
+	}
+
+	attrs := []any{
+		"type", next.Type,
+		"status", next.Status,
+		"previous", previous,
+		"duration", time.Since(since),
+		"transferred", next.Transferred,
+		"total", next.Total,
+	}
+	level := slog.LevelInfo
+	if next.Error != "" {
+		attrs = append(attrs, "error", next.Error)
+		level = slog.LevelWarn
+	}
+	next.logger().Log(context.Background(), level, "Transfer status changed", attrs...)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "warn")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	logger.Info("dropped")
+	logger.Warn("kept", "n", 1)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON line, got %q", buf.String())
+	}
+	if entry["msg"] != "kept" || entry["n"] != float64(1) {
+		t.Errorf("entry = %v", entry)
+	}
+
+	if _, err := newLogger(&buf, "xml", "info"); err == nil {
+		t.Error("newLogger should reject unknown formats")
+	}
+	if _, err := newLogger(&buf, "text", "loud"); err == nil {
+		t.Error("newLogger should reject unknown levels")
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFrom(r.Context()).Info("hello")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	generated := w.Header().Get(requestIDHeader)
+	if len(generated) != 16 {
+		t.Errorf("generated request ID = %q, want 16 hex chars", generated)
+	}
+	if !strings.Contains(buf.String(), "request_id="+generated) {
+		t.Errorf("log line %q lacks the request ID", buf.String())
+	}
+
+	// IDs set by a proxy are kept, unless they are unsafe
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestIDHeader, "proxy-123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get(requestIDHeader); got != "proxy-123" {
+		t.Errorf("request ID = %q, want %q", got, "proxy-123")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestIDHeader, "bad id\nwith newline")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get(requestIDHeader); got == "bad id\nwith newline" {
+		t.Error("unsafe request ID was passed through")
+	}
+}
+
+func TestTransferTransitionLogging(t *testing.T) {
+	var buf bytes.Buffer
+	server := NewServer(Config{})
+	transfer := &TransferStatus{
+		ID:        "recv-1",
+		Type:      "receive",
+		Status:    "receiving",
+		CreatedAt: time.Now(),
+		log:       slog.New(slog.NewJSONHandler(&buf, nil)).With("transfer", "recv-1"),
+	}
+
+	server.setTransfer(transfer)
+	transfer.Transferred = 10
+	server.setTransfer(transfer) // progress only, not logged
+	transfer.Status = "error"
+	transfer.Error = "boom"
+	server.setTransfer(transfer)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), buf.String())
+	}
+	var entry map[string]any
+	json.Unmarshal([]byte(lines[1]), &entry)
+	if entry["level"] != "WARN" || entry["transfer"] != "recv-1" || entry["previous"] != "receiving" ||
+		entry["status"] != "error" || entry["error"] != "boom" || entry["transferred"] != float64(10) {
+		t.Errorf("entry = %v", entry)
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Error("entry has no duration")
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// mailboxExpiry is how long a mailbox nobody is connected to, and the
+	// nameplate pointing at it, outlive their last message.
+	mailboxExpiry = 2 * time.Hour
+	// mailboxPruneInterval is how often expired mailboxes are removed.
+	mailboxPruneInterval = time.Minute
+	// mailboxMaxMessages caps the messages one mailbox holds. A transfer
+	// takes about a dozen.
+	mailboxMaxMessages = 100
+	// mailboxMaxMessageSize caps one client message. Text sends travel
+	// through the mailbox hex encoded, so this allows texts of about
+	// 120 KiB; everything else is far smaller.
+	mailboxMaxMessageSize = 256 << 10
+	// mailboxMaxBytes caps the message bodies one mailbox holds.
+	mailboxMaxBytes = 1 << 20
+	// mailboxMaxConns caps concurrent client connections.
+	mailboxMaxConns = 1000
+	// mailboxMaxApps caps the AppIDs with state, and mailboxMaxMailboxes
+	// the open mailboxes of each.
+	mailboxMaxApps      = 16
+	mailboxMaxMailboxes = 1000
+	// mailboxQueueSize is how many messages a connection may fall behind
+	// before it is dropped.
+	mailboxQueueSize = 128
+)
+
+var (
+	errMailboxCrowded     = errors.New("crowded")
+	errMailboxTooMany     = errors.New("too many open mailboxes")
+	errMailboxTooManyApps = errors.New("too many apps")
+)
+
+// mailboxServer is an in-process Magic Wormhole rendezvous (mailbox)
+// server. It speaks the websocket protocol of the public server, so the
+// wormhole CLI and wormhole-william clients can meet on it: nameplates are
+// allocated and claimed by up to two sides, and the messages one side adds
+// to a mailbox are relayed to everyone who opened it. All state is kept in
+// memory, per AppID.
+type mailboxServer struct {
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	apps  map[string]*mailboxApp
+	conns map[*mailboxConn]struct{}
+}
+
+// mailboxApp holds the nameplates and mailboxes of one AppID.
+type mailboxApp struct {
+	nameplates map[string]*mailboxNameplate
+	mailboxes  map[string]*mailbox
+}
+
+// mailboxNameplate is the short number at the start of a code. It names a
+// mailbox and lives as long as that mailbox does, or until every side that
+// claimed it has released it.
+type mailboxNameplate struct {
+	mailbox string
+	sides   map[string]bool // side → still claimed
+}
+
+type mailbox struct {
+	sides     map[string]bool // side → still open
+	messages  []mailboxMessage
+	size      int // bytes of message phases and bodies
+	listeners map[*mailboxConn]struct{}
+	updated   time.Time
+}
+
+// mailboxMessage is anything the server sends. Each type fills in its own
+// fields and leaves the rest empty.
+type mailboxMessage struct {
+	Type       string               `json:"type"`
+	ID         string               `json:"id,omitempty"`
+	Welcome    *mailboxWelcome      `json:"welcome,omitempty"`
+	Nameplate  string               `json:"nameplate,omitempty"`
+	Nameplates []mailboxNameplateID `json:"nameplates,omitempty"`
+	Mailbox    string               `json:"mailbox,omitempty"`
+	Side       string               `json:"side,omitempty"`
+	Phase      string               `json:"phase,omitempty"`
+	Body       string               `json:"body,omitempty"`
+	Pong       *int                 `json:"pong,omitempty"`
+	Error      string               `json:"error,omitempty"`
+	Orig       json.RawMessage      `json:"orig,omitempty"`
+	ServerRX   float64              `json:"server_rx,omitempty"`
+	ServerTX   float64              `json:"server_tx"`
+}
+
+type mailboxWelcome struct {
+	MOTD string `json:"motd,omitempty"`
+}
+
+type mailboxNameplateID struct {
+	ID string `json:"id"`
+}
+
+// mailboxRequest is anything a client sends.
+type mailboxRequest struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Side      string `json:"side"`
+	AppID     string `json:"appid"`
+	Nameplate string `json:"nameplate"`
+	Mailbox   string `json:"mailbox"`
+	Phase     string `json:"phase"`
+	Body      string `json:"body"`
+	Ping      *int   `json:"ping"`
+}
+
+// mailboxConn is one client connection. Its queue is drained by a single
+// writer, so relaying a message never waits on a slow client. The fields
+// below it are guarded by mailboxServer.mu.
+type mailboxConn struct {
+	ws    *websocket.Conn
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+
+	appID     string
+	side      string // set by bind
+	nameplate string // claimed on this connection
+	mailbox   string // opened on this connection
+}
+
+func newMailboxServer() *mailboxServer {
+	return &mailboxServer{
+		// Peers are command line clients, not browsers
+		upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		apps:     make(map[string]*mailboxApp),
+		conns:    make(map[*mailboxConn]struct{}),
+	}
+}
+
+// startMailboxServer serves the mailbox protocol on addr and returns the
+// server together with the URL this process reaches it at.
+func startMailboxServer(addr string) (*http.Server, string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	mb := newMailboxServer()
+	srv := &http.Server{Handler: mb}
+	// Shutdown leaves hijacked connections alone
+	srv.RegisterOnShutdown(mb.closeAll)
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Mailbox server error", "err", err)
+		}
+	}()
+
+	ticker := time.NewTicker(mailboxPruneInterval)
+	go func() {
+		for now := range ticker.C {
+			mb.prune(now)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return srv, "ws://" + net.JoinHostPort(host, port) + "/v1", nil
+}
+
+func (m *mailboxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	full := len(m.conns) >= mailboxMaxConns
+	m.mu.Unlock()
+	if full {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ws.SetReadLimit(mailboxMaxMessageSize)
+	c := &mailboxConn{
+		ws:    ws,
+		queue: make(chan []byte, mailboxQueueSize),
+		done:  make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.conns[c] = struct{}{}
+	m.mu.Unlock()
+	defer m.disconnect(c)
+	go c.writeLoop()
+
+	c.send(mailboxMessage{Type: "welcome", Welcome: &mailboxWelcome{}})
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req mailboxRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.send(mailboxMessage{Type: "error", Error: "invalid message"})
+			continue
+		}
+		c.send(mailboxMessage{Type: "ack", ID: req.ID})
+		if err := m.handle(c, &req, time.Now()); err != nil {
+			c.send(mailboxMessage{Type: "error", Error: err.Error(), Orig: data})
+		}
+	}
+}
+
+// handle carries out one request from c.
+func (m *mailboxServer) handle(c *mailboxConn, req *mailboxRequest, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch req.Type {
+	case "ping":
+		if req.Ping == nil {
+			return errors.New("ping requires 'ping'")
+		}
+		c.send(mailboxMessage{Type: "pong", Pong: req.Ping})
+		return nil
+	case "bind":
+		if c.side != "" {
+			return errors.New("already bound")
+		}
+		if req.AppID == "" || req.Side == "" {
+			return errors.New("bind requires 'appid' and 'side'")
+		}
+		if m.apps[req.AppID] == nil && len(m.apps) >= mailboxMaxApps {
+			return errMailboxTooManyApps
+		}
+		c.appID, c.side = req.AppID, req.Side
+		m.app(c.appID)
+		return nil
+	}
+	if c.side == "" {
+		return errors.New("must bind first")
+	}
+	app := m.app(c.appID)
+
+	switch req.Type {
+	case "list":
+		ids := make([]mailboxNameplateID, 0, len(app.nameplates))
+		for name := range app.nameplates {
+			ids = append(ids, mailboxNameplateID{ID: name})
+		}
+		c.send(mailboxMessage{Type: "nameplates", Nameplates: ids})
+
+	case "allocate":
+		if c.nameplate != "" {
+			return errors.New("already claimed a nameplate")
+		}
+		name := app.freeNameplate()
+		if _, err := app.claim(name, c.side, now); err != nil {
+			return err
+		}
+		c.nameplate = name
+		c.send(mailboxMessage{Type: "allocated", Nameplate: name})
+
+	case "claim":
+		if !nameplatePattern.MatchString(req.Nameplate) {
+			return errors.New("claim requires a numeric 'nameplate'")
+		}
+		if c.nameplate != "" && c.nameplate != req.Nameplate {
+			return errors.New("only one claim per connection")
+		}
+		id, err := app.claim(req.Nameplate, c.side, now)
+		if err != nil {
+			return err
+		}
+		c.nameplate = req.Nameplate
+		c.send(mailboxMessage{Type: "claimed", Mailbox: id})
+
+	case "release":
+		name := req.Nameplate
+		if name == "" {
+			name = c.nameplate
+		}
+		if name == "" || (c.nameplate != "" && name != c.nameplate) {
+			return errors.New("release requires the claimed nameplate")
+		}
+		app.release(name, c.side)
+		c.nameplate = ""
+		c.send(mailboxMessage{Type: "released"})
+
+	case "open":
+		if c.mailbox != "" {
+			return errors.New("only one open per connection")
+		}
+		if req.Mailbox == "" {
+			return errors.New("open requires 'mailbox'")
+		}
+		mb, err := app.open(req.Mailbox, c, now)
+		if err != nil {
+			return err
+		}
+		c.mailbox = req.Mailbox
+		for _, msg := range mb.messages {
+			c.send(msg)
+		}
+
+	case "add":
+		mb := app.mailboxes[c.mailbox]
+		if mb == nil {
+			return errors.New("must open a mailbox before adding")
+		}
+		size := len(req.Phase) + len(req.Body)
+		if len(mb.messages) >= mailboxMaxMessages || mb.size+size > mailboxMaxBytes {
+			return errors.New("mailbox is full")
+		}
+		msg := mailboxMessage{
+			Type:     "message",
+			ID:       hex.EncodeToString(newSecret()[:4]),
+			Side:     c.side,
+			Phase:    req.Phase,
+			Body:     req.Body,
+			ServerRX: serverTime(now),
+		}
+		mb.messages = append(mb.messages, msg)
+		mb.size += size
+		mb.updated = now
+		for listener := range mb.listeners {
+			listener.send(msg)
+		}
+
+	case "close":
+		id := req.Mailbox
+		if id == "" {
+			id = c.mailbox
+		}
+		app.close(id, c)
+		c.mailbox = ""
+		c.send(mailboxMessage{Type: "closed"})
+
+	default:
+		return fmt.Errorf("unknown type %q", req.Type)
+	}
+	return nil
+}
+
+// app returns the state of appID, creating it on first use. m.mu must be
+// held.
+func (m *mailboxServer) app(appID string) *mailboxApp {
+	app := m.apps[appID]
+	if app == nil {
+		app = &mailboxApp{
+			nameplates: make(map[string]*mailboxNameplate),
+			mailboxes:  make(map[string]*mailbox),
+		}
+		m.apps[appID] = app
+	}
+	return app
+}
+
+// freeNameplate returns the lowest nameplate not in use, keeping codes
+// short.
+func (a *mailboxApp) freeNameplate() string {
+	for i := 1; ; i++ {
+		if name := strconv.Itoa(i); a.nameplates[name] == nil {
+			return name
+		}
+	}
+}
+
+// claim adds side to a nameplate, creating it and its mailbox if need be,
+// and returns the mailbox ID. A nameplate takes two sides; sides that
+// released it still count, so a third cannot take their place.
+func (a *mailboxApp) claim(name, side string, now time.Time) (string, error) {
+	np := a.nameplates[name]
+	if np == nil {
+		if len(a.mailboxes) >= mailboxMaxMailboxes {
+			return "", errMailboxTooMany
+		}
+		np = &mailboxNameplate{
+			mailbox: hex.EncodeToString(newSecret()[:10]),
+			sides:   make(map[string]bool),
+		}
+		a.nameplates[name] = np
+	}
+	if _, ok := np.sides[side]; !ok && len(np.sides) >= 2 {
+		return "", errMailboxCrowded
+	}
+	np.sides[side] = true
+	if a.mailboxes[np.mailbox] == nil {
+		a.mailboxes[np.mailbox] = newMailbox(now)
+	}
+	return np.mailbox, nil
+}
+
+// release drops side's claim on a nameplate, deleting it once no side
+// holds it. The mailbox stays until it is closed.
+func (a *mailboxApp) release(name, side string) {
+	np := a.nameplates[name]
+	if np == nil {
+		return
+	}
+	if _, ok := np.sides[side]; ok {
+		np.sides[side] = false
+	}
+	for _, claimed := range np.sides {
+		if claimed {
+			return
+		}
+	}
+	delete(a.nameplates, name)
+}
+
+// open subscribes c to a mailbox, creating it if need be; clients may
+// learn a mailbox ID other than through a nameplate.
+func (a *mailboxApp) open(id string, c *mailboxConn, now time.Time) (*mailbox, error) {
+	mb := a.mailboxes[id]
+	if mb == nil {
+		if len(a.mailboxes) >= mailboxMaxMailboxes {
+			return nil, errMailboxTooMany
+		}
+		mb = newMailbox(now)
+		a.mailboxes[id] = mb
+	}
+	if _, ok := mb.sides[c.side]; !ok && len(mb.sides) >= 2 {
+		return nil, errMailboxCrowded
+	}
+	mb.sides[c.side] = true
+	mb.listeners[c] = struct{}{}
+	mb.updated = now
+	return mb, nil
+}
+
+// close unsubscribes c from a mailbox and deletes the mailbox, with any
+// nameplate still naming it, once every side that opened it has closed.
+func (a *mailboxApp) close(id string, c *mailboxConn) {
+	mb := a.mailboxes[id]
+	if mb == nil {
+		return
+	}
+	delete(mb.listeners, c)
+	if _, ok := mb.sides[c.side]; ok {
+		mb.sides[c.side] = false
+	}
+	for _, open := range mb.sides {
+		if open {
+			return
+		}
+	}
+	a.deleteMailbox(id)
+}
+
+func (a *mailboxApp) deleteMailbox(id string) {
+	delete(a.mailboxes, id)
+	for name, np := range a.nameplates {
+		if np.mailbox == id {
+			delete(a.nameplates, name)
+		}
+	}
+}
+
+func newMailbox(now time.Time) *mailbox {
+	return &mailbox{
+		sides:     make(map[string]bool),
+		listeners: make(map[*mailboxConn]struct{}),
+		updated:   now,
+	}
+}
+
+// prune removes mailboxes nobody is connected to that have been quiet for
+// mailboxExpiry, and their nameplates.
+func (m *mailboxServer) prune(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for appID, app := range m.apps {
+		for id, mb := range app.mailboxes {
+			if len(mb.listeners) == 0 && now.Sub(mb.updated) > mailboxExpiry {
+				app.deleteMailbox(id)
+			}
+		}
+		if len(app.mailboxes) == 0 && len(app.nameplates) == 0 {
+			delete(m.apps, appID)
+		}
+	}
+}
+
+// disconnect forgets a closed connection. Its claims and open sides stay,
+// as the client may reconnect; expiry cleans up after those that do not.
+func (m *mailboxServer) disconnect(c *mailboxConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, c)
+	if app := m.apps[c.appID]; app != nil {
+		if mb := app.mailboxes[c.mailbox]; mb != nil {
+			delete(mb.listeners, c)
+		}
+	}
+	c.close()
+}
+
+// closeAll drops every connection, for shutdown.
+func (m *mailboxServer) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c := range m.conns {
+		c.close()
+	}
+}
+
+// send queues msg for the client, dropping a client too far behind.
+func (c *mailboxConn) send(msg mailboxMessage) {
+	msg.ServerTX = serverTime(time.Now())
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case c.queue <- data:
+	default:
+		c.close()
+	}
+}
+
+func (c *mailboxConn) writeLoop() {
+	for {
+		select {
+		case data := <-c.queue:
+			if err := c.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *mailboxConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+// serverTime is the protocol's timestamp: seconds since the epoch.
+func serverTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
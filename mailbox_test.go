@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// newTestMailbox serves an embedded mailbox and returns it with its URL.
+func newTestMailbox(t *testing.T) (*mailboxServer, string) {
+	t.Helper()
+	mb := newMailboxServer()
+	ts := httptest.NewServer(mb)
+	t.Cleanup(func() {
+		mb.closeAll()
+		ts.Close()
+	})
+
+	relay := wormhole.DefaultTransitRelayAddress
+	wormhole.DefaultTransitRelayAddress = ""
+	t.Cleanup(func() { wormhole.DefaultTransitRelayAddress = relay })
+
+	return mb, "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1"
+}
+
+// dialMailbox connects a raw protocol client bound as side.
+func dialMailbox(t *testing.T, url, side string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if msg := readMailbox(t, ws); msg.Type != "welcome" {
+		t.Fatalf("first message = %+v, want welcome", msg)
+	}
+	mailboxRequestAcked(t, ws, mailboxRequest{Type: "bind", AppID: "test", Side: side})
+	return ws
+}
+
+func readMailbox(t *testing.T, ws *websocket.Conn) mailboxMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg mailboxMessage
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	return msg
+}
+
+// mailboxRequestAcked sends req and returns the message after its ack.
+func mailboxRequestAcked(t *testing.T, ws *websocket.Conn, req mailboxRequest) mailboxMessage {
+	t.Helper()
+	req.ID = req.Type + "-1"
+	if err := ws.WriteJSON(req); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	if ack := readMailbox(t, ws); ack.Type != "ack" || ack.ID != req.ID {
+		t.Fatalf("got %+v, want the ack of %s", ack, req.ID)
+	}
+	if req.Type == "bind" || req.Type == "open" || req.Type == "add" {
+		return mailboxMessage{}
+	}
+	return readMailbox(t, ws)
+}
+
+func TestMailboxServerTransfer(t *testing.T) {
+	mb, url := newTestMailbox(t)
+	server := NewServer(Config{RendezvousURL: url})
+
+	w := sendTextRequest(server, `{"text":"air-gapped"}`)
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	code := waitForStatus(t, server, resp.ID, "waiting").Code
+	if !strings.HasPrefix(code, "1-") {
+		t.Errorf("code = %q, want the first free nameplate", code)
+	}
+
+	receiver := wormhole.Client{RendezvousURL: url}
+	msg, err := receiver.Receive(context.Background(), code)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	text, _ := io.ReadAll(msg)
+	if string(text) != "air-gapped" {
+		t.Errorf("received %q", text)
+	}
+	waitForStatus(t, server, resp.ID, "complete")
+
+	// Both sides release the nameplate once they have heard from each other
+	waitFor(t, func() bool {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+		return len(mb.apps[wormhole.WormholeCLIAppID].nameplates) == 0 && len(mb.conns) == 0
+	})
+	mb.prune(time.Now().Add(2 * mailboxExpiry))
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if len(mb.apps) != 0 {
+		t.Errorf("finished mailbox was not pruned: %+v", mb.apps)
+	}
+}
+
+func TestMailboxServerProtocol(t *testing.T) {
+	_, url := newTestMailbox(t)
+
+	unbound, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer unbound.Close()
+	readMailbox(t, unbound)
+	if msg := mailboxRequestAcked(t, unbound, mailboxRequest{Type: "allocate"}); msg.Type != "error" {
+		t.Errorf("allocate before bind = %+v, want an error", msg)
+	}
+
+	ping := 42
+	if msg := mailboxRequestAcked(t, unbound, mailboxRequest{Type: "ping", Ping: &ping}); msg.Type != "pong" || msg.Pong == nil || *msg.Pong != ping {
+		t.Errorf("ping = %+v, want pong 42", msg)
+	}
+
+	a, b, c := dialMailbox(t, url, "side-a"), dialMailbox(t, url, "side-b"), dialMailbox(t, url, "side-c")
+	claimed := mailboxRequestAcked(t, a, mailboxRequest{Type: "claim", Nameplate: "5"})
+	if claimed.Type != "claimed" || claimed.Mailbox == "" {
+		t.Fatalf("claim = %+v", claimed)
+	}
+	if msg := mailboxRequestAcked(t, b, mailboxRequest{Type: "claim", Nameplate: "5"}); msg.Mailbox != claimed.Mailbox {
+		t.Errorf("second claim = %+v, want mailbox %s", msg, claimed.Mailbox)
+	}
+	if msg := mailboxRequestAcked(t, c, mailboxRequest{Type: "claim", Nameplate: "5"}); msg.Type != "error" || msg.Error != "crowded" {
+		t.Errorf("third claim = %+v, want crowded", msg)
+	}
+	if msg := mailboxRequestAcked(t, c, mailboxRequest{Type: "list"}); len(msg.Nameplates) != 1 || msg.Nameplates[0].ID != "5" {
+		t.Errorf("list = %+v", msg)
+	}
+
+	// Messages are relayed to every side, including ones that open later
+	mailboxRequestAcked(t, a, mailboxRequest{Type: "open", Mailbox: claimed.Mailbox})
+	mailboxRequestAcked(t, a, mailboxRequest{Type: "add", Phase: "pake", Body: "abcd"})
+	if msg := readMailbox(t, a); msg.Type != "message" || msg.Side != "side-a" || msg.Body != "abcd" {
+		t.Errorf("echo = %+v", msg)
+	}
+	mailboxRequestAcked(t, b, mailboxRequest{Type: "open", Mailbox: claimed.Mailbox})
+	if msg := readMailbox(t, b); msg.Type != "message" || msg.Phase != "pake" || msg.Body != "abcd" {
+		t.Errorf("replay = %+v", msg)
+	}
+}
+
+func TestMailboxServerExpiry(t *testing.T) {
+	mb, url := newTestMailbox(t)
+
+	ws := dialMailbox(t, url, "side-a")
+	claimed := mailboxRequestAcked(t, ws, mailboxRequest{Type: "claim", Nameplate: "7"})
+	mailboxRequestAcked(t, ws, mailboxRequest{Type: "open", Mailbox: claimed.Mailbox})
+
+	// A mailbox someone is connected to never expires
+	mb.prune(time.Now().Add(2 * mailboxExpiry))
+	mb.mu.Lock()
+	kept := len(mb.apps["test"].nameplates)
+	mb.mu.Unlock()
+	if kept != 1 {
+		t.Fatalf("prune removed a mailbox in use")
+	}
+
+	ws.Close()
+	waitFor(t, func() bool {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+		return len(mb.conns) == 0
+	})
+	mb.prune(time.Now().Add(2 * mailboxExpiry))
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if len(mb.apps) != 0 {
+		t.Errorf("abandoned mailbox was not pruned: %+v", mb.apps)
+	}
+}
+
+func TestMailboxServerLimits(t *testing.T) {
+	mb, url := newTestMailbox(t)
+
+	ws := dialMailbox(t, url, "side-a")
+	claimed := mailboxRequestAcked(t, ws, mailboxRequest{Type: "claim", Nameplate: "3"})
+	mailboxRequestAcked(t, ws, mailboxRequest{Type: "open", Mailbox: claimed.Mailbox})
+	body := strings.Repeat("ab", 125<<10)
+	for i := 0; i < 4; i++ {
+		mailboxRequestAcked(t, ws, mailboxRequest{Type: "add", Phase: strconv.Itoa(i), Body: body})
+		readMailbox(t, ws)
+	}
+	mailboxRequestAcked(t, ws, mailboxRequest{Type: "add", Phase: "4", Body: body})
+	if msg := readMailbox(t, ws); msg.Type != "error" || msg.Error != "mailbox is full" {
+		t.Errorf("add past the byte cap = %s %q, want mailbox is full", msg.Type, msg.Error)
+	}
+
+	mb.mu.Lock()
+	app := mb.apps["test"]
+	for i := len(app.mailboxes); i < mailboxMaxMailboxes; i++ {
+		app.mailboxes[strconv.Itoa(i)] = newMailbox(time.Now())
+	}
+	mb.mu.Unlock()
+	other := dialMailbox(t, url, "side-b")
+	if msg := mailboxRequestAcked(t, other, mailboxRequest{Type: "allocate"}); msg.Type != "error" || msg.Error != errMailboxTooMany.Error() {
+		t.Errorf("allocate past the mailbox cap = %+v", msg)
+	}
+}
@@ -6,18 +6,22 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,104 +31,336 @@ import (
 
 const (
 	// Transfer cleanup settings
-	transferTTL      = 1 * time.Hour
-	cleanupInterval  = 5 * time.Minute
-	maxFilenameLen   = 255
-	shutdownTimeout  = 30 * time.Second
+	transferTTL     = 1 * time.Hour
+	cleanupInterval = 5 * time.Minute
+	maxFilenameLen  = 255
+	shutdownTimeout = 30 * time.Second
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
+// TransferStatus is a snapshot of a transfer. Snapshots are immutable once
+// stored: changes go through updateTransfer, which publishes a new one.
 type TransferStatus struct {
-	ID           string    `json:"id"`
-	Type         string    `json:"type"` // "send" or "receive"
-	Status       string    `json:"status"`
-	Code         string    `json:"code,omitempty"`
-	Filename     string    `json:"filename,omitempty"`
-	Progress     float64   `json:"progress"`
-	Transferred  int64     `json:"transferred"`
-	Total        int64     `json:"total"`
-	Error        string    `json:"error,omitempty"`
-	TextContent  string    `json:"textContent,omitempty"`
-	DownloadPath string    `json:"downloadPath,omitempty"`
-	CreatedAt    time.Time `json:"-"`
+	ID            string      `json:"id"`
+	Type          string      `json:"type"` // "send" or "receive"
+	Status        string      `json:"status"`
+	Code          string      `json:"code,omitempty"`
+	Filename      string      `json:"filename,omitempty"`
+	ContentType   string      `json:"contentType,omitempty"` // "text", "file" or "directory"
+	FileCount     int         `json:"fileCount,omitempty"`
+	Progress      float64     `json:"progress"`
+	Transferred   int64       `json:"transferred"`
+	Total         int64       `json:"total"`
+	Throughput    int64       `json:"throughput,omitempty"` // bytes per second over the last few seconds
+	ETA           int64       `json:"eta,omitempty"`        // estimated seconds left
+	Verifier      string      `json:"verifier,omitempty"`   // hex verifier derived from the shared key, in verify mode
+	VerifierWords []string    `json:"verifierWords,omitempty"`
+	Error         string      `json:"error,omitempty"`
+	TextContent   string      `json:"textContent,omitempty"`
+	DownloadPath  string      `json:"downloadPath,omitempty"`
+	Files         []FileEntry `json:"files,omitempty"` // contents of a received directory
+	Owner         string      `json:"owner,omitempty"` // authenticated user who created it
+	Version       int64       `json:"version"`         // bumped on every update
+	CreatedAt     time.Time   `json:"-"`
+
+	// log is scoped to this transfer and the request that created it
+	log *slog.Logger
+	// statusSince is when the transfer entered its current status
+	statusSince time.Time
+
+	// cancel aborts the goroutine driving this transfer
+	cancel context.CancelFunc
+	// decision carries the user's answer to an offered receive or to a
+	// verifier
+	decision chan bool
+}
+
+// finished reports whether the transfer has reached a terminal state.
+func (t *TransferStatus) finished() bool {
+	switch t.Status {
+	case "complete", "error", "cancelled", "rejected":
+		return true
+	}
+	return false
 }
 
 // Validation patterns
 var (
-	// Wormhole codes are: number-word-word (e.g., "7-guitarist-revenge")
-	wormholeCodePattern = regexp.MustCompile(`^\d+-[a-zA-Z]+-[a-zA-Z]+$`)
-	// Transfer IDs are: send-{timestamp} or recv-{timestamp}
-	transferIDPattern = regexp.MustCompile(`^(send|recv)-\d+$`)
+	// Wormhole codes are: number-word[-word...] (e.g., "7-guitarist-revenge")
+	wormholeCodePattern = regexp.MustCompile(`^\d+(-\w+)+$`)
+	nameplatePattern    = regexp.MustCompile(`^\d+$`)
+	// Transfer IDs are: send-{128 random bits} or recv-{128 random bits}
+	transferIDPattern = regexp.MustCompile(`^(send|recv)-[0-9a-f]{32}$`)
 )
 
 type Server struct {
-	transfers   sync.Map
-	subscribers sync.Map // map[transferID]map[*websocket.Conn]bool
-	mu          sync.Mutex
-	tempDir     string
-}
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow same-origin connections
-	},
+	store    TransferStore
+	events   *eventBus
+	mu       sync.Mutex                  // serializes transfer updates
+	progress map[string]*progressTracker // by transfer ID, guarded by mu
+	tempDir  string
+	config   Config
+	secret   []byte // signs transfer capabilities
+	auth     []Authenticator
+	oidc     *oidcProvider
+	upgrader websocket.Upgrader
+
+	trustedProxies []*net.IPNet
+	limiter        *rateLimiter   // nil when rate limiting is off
+	slots          *transferSlots // nil when concurrency is uncapped
+	limitStats     limitStats
+	metrics        *metrics
+
+	rendezvousCheck rendezvousCheck
+	wsConns         atomic.Int64  // open /api/ws connections
+	relay           *transitRelay // nil unless serving a transit relay
+	// shuttingDown makes /readyz fail once shutdown has begun
+	shuttingDown atomic.Bool
 }
 
-func NewServer() *Server {
+func NewServer(cfg Config) *Server {
 	tempDir := os.TempDir()
-	return &Server{
-		tempDir: filepath.Join(tempDir, "wormhole-web"),
+	s := &Server{
+		store:    newMemoryStore(),
+		events:   newEventBus(),
+		progress: make(map[string]*progressTracker),
+		tempDir:  filepath.Join(tempDir, "wormhole-web"),
+		config:   cfg,
+		secret:   newSecret(),
+		metrics:  newMetrics(),
 	}
+	s.upgrader = websocket.Upgrader{CheckOrigin: s.originAllowed}
+	s.trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies) // validated by loadConfig
+	s.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	s.slots = newTransferSlots(cfg.MaxActiveTransfers, cfg.MaxQueuedTransfers)
+	return s
 }
 
 func (s *Server) getTransfer(id string) *TransferStatus {
-	if val, ok := s.transfers.Load(id); ok {
-		return val.(*TransferStatus)
-	}
-	return nil
+	return s.store.Get(id)
 }
 
+// setTransfer stores a copy of t as the transfer's latest snapshot and
+// publishes it, whatever state the transfer was in. It is how transfers
+// are created; goroutines driving a transfer use updateTransfer.
 func (s *Server) setTransfer(t *TransferStatus) {
-	s.transfers.Store(t.ID, t)
-	s.notifySubscribers(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := *t
+	s.commit(s.store.Get(t.ID), &snapshot)
+}
+
+// updateTransfer applies fn to a copy of the transfer's latest snapshot
+// and publishes the result. Finished transfers are final: when the
+// transfer is gone or finished, fn is not called and ok is false. fn runs
+// under the server lock and must not call back into the server.
+func (s *Server) updateTransfer(id string, fn func(t *TransferStatus)) (snapshot *TransferStatus, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.store.Get(id)
+	if current == nil || current.finished() {
+		return current, false
+	}
+	next := *current
+	fn(&next)
+	s.commit(current, &next)
+	return &next, true
+}
+
+// commit replaces prev with next in the store and notifies subscribers.
+// s.mu must be held, which keeps snapshots in order.
+func (s *Server) commit(prev, next *TransferStatus) {
+	next.Version = 1
+	if prev != nil {
+		next.Version = prev.Version + 1
+	}
+	if prev == nil || prev.Status != next.Status {
+		logTransition(prev, next)
+		next.statusSince = time.Now()
+	}
+	if next.finished() {
+		s.finishProgress(next)
+	}
+	if err := s.store.Set(next); err != nil {
+		next.logger().Error("Failed to persist transfer", "err", err)
+	}
+	s.notifySubscribers(next)
 }
 
 func (s *Server) deleteTransfer(id string) {
-	s.transfers.Delete(id)
+	s.mu.Lock()
+	s.forgetProgress(id)
+	s.mu.Unlock()
+	if err := s.store.Delete(id); err != nil {
+		slog.Error("Failed to persist transfer deletion", "transfer", id, "err", err)
+	}
+}
+
+var (
+	errTransferNotFound   = errors.New("transfer not found")
+	errTransferFinished   = errors.New("transfer already finished")
+	errTransferNotOffered = errors.New("transfer is not awaiting a decision")
+)
+
+// cancelTransfer stops an in-flight transfer, closing its mailbox and
+// removing any temp files.
+func (s *Server) cancelTransfer(id string) error {
+	return s.abortTransfer(id, nil)
+}
+
+// abortTransfer stops an in-flight transfer like cancelTransfer. A non-nil
+// reason marks it as failed with that error instead of cancelled.
+func (s *Server) abortTransfer(id string, reason error) error {
+	class := "cancelled"
+	transfer, ok := s.updateTransfer(id, func(t *TransferStatus) {
+		t.Status = "cancelled"
+		if reason != nil {
+			class = errorClass(reason)
+			t.Status = "error"
+			t.Error = reason.Error()
+		}
+	})
+	if transfer == nil {
+		return errTransferNotFound
+	}
+	if !ok {
+		return errTransferFinished
+	}
+
+	if transfer.cancel != nil {
+		transfer.cancel()
+	}
+	os.RemoveAll(filepath.Join(s.tempDir, id))
+	s.metrics.transferFailed(transfer, class)
+	return nil
+}
+
+// decideTransfer answers the question a transfer is waiting on: whether
+// to take an offered receive, or whether the verifier matches the peer's.
+// It holds s.mu so the answer cannot leak into the next question.
+func (s *Server) decideTransfer(id string, accept bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfer := s.store.Get(id)
+	if transfer == nil {
+		return errTransferNotFound
+	}
+	if (transfer.Status != "offered" && transfer.Status != "verifying") || transfer.decision == nil {
+		return errTransferNotOffered
+	}
+
+	select {
+	case transfer.decision <- accept:
+		return nil
+	default:
+		// Someone else already answered
+		return errTransferNotOffered
+	}
+}
+
+// failTransfer records err on the transfer. Errors caused by cancellation
+// are dropped since cancelTransfer has already reported the outcome.
+func (s *Server) failTransfer(ctx context.Context, id string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	transfer, ok := s.updateTransfer(id, func(t *TransferStatus) {
+		t.Status = "error"
+		t.Error = err.Error()
+	})
+	if ok {
+		s.metrics.transferFailed(transfer, errorClass(err))
+	}
+}
+
+// completeTransfer marks the transfer complete after fn has filled in the
+// final details.
+func (s *Server) completeTransfer(id string, fn func(t *TransferStatus)) {
+	transfer, ok := s.updateTransfer(id, func(t *TransferStatus) {
+		fn(t)
+		t.Status = "complete"
+		t.Progress = 100
+	})
+	if ok {
+		s.metrics.transferCompleted(transfer)
+	}
 }
 
-// WebSocket subscriber management
-func (s *Server) addSubscriber(transferID string, conn *websocket.Conn) {
-	actual, _ := s.subscribers.LoadOrStore(transferID, &sync.Map{})
-	subscribers := actual.(*sync.Map)
-	subscribers.Store(conn, true)
+// sendWaiting records the code the mailbox allocated for a send, which
+// now waits for its receiver.
+func (s *Server) sendWaiting(id, code string) {
+	transfer, ok := s.updateTransfer(id, func(t *TransferStatus) {
+		t.Code = code
+		t.Status = "waiting"
+	})
+	if ok {
+		s.metrics.codeAllocated(transfer)
+	}
 }
 
-func (s *Server) removeSubscriber(transferID string, conn *websocket.Conn) {
-	if val, ok := s.subscribers.Load(transferID); ok {
-		subscribers := val.(*sync.Map)
-		subscribers.Delete(conn)
+// finishSend waits for the receiver to pick up a send and records the result.
+func (s *Server) finishSend(ctx context.Context, id string, status chan wormhole.SendResult) {
+	select {
+	case result := <-status:
+		if result.Error != nil {
+			s.failTransfer(ctx, id, result.Error)
+		} else if result.OK && ctx.Err() == nil {
+			s.completeTransfer(id, func(t *TransferStatus) {
+				t.Transferred = t.Total
+			})
+		}
+	case <-ctx.Done():
 	}
 }
 
+// notifySubscribers queues the snapshot t for everyone watching it.
 func (s *Server) notifySubscribers(t *TransferStatus) {
-	if val, ok := s.subscribers.Load(t.ID); ok {
-		subscribers := val.(*sync.Map)
-		data, err := json.Marshal(t)
-		if err != nil {
-			return
+	if !s.events.hasSubscribers(t.ID) {
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	s.events.publish(t.ID, event{version: t.Version, data: data})
+}
+
+// subscribe registers for a transfer's events. Its current status is
+// queued first, under the same lock as updates, so nothing is missed or
+// delivered out of order.
+func (s *Server) subscribe(id string) *subscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.events.subscribe(id)
+	if t := s.store.Get(id); t != nil {
+		if data, err := json.Marshal(t); err == nil {
+			sub.queue <- event{version: t.Version, data: data} // a fresh queue has room
 		}
-		subscribers.Range(func(key, _ any) bool {
-			conn := key.(*websocket.Conn)
+	}
+	return sub
+}
+
+// writeEvents is the only goroutine writing status messages to conn. It
+// runs until the subscription ends, and hangs up on evicted subscribers.
+func writeEvents(conn *websocket.Conn, sub *subscriber) {
+	for {
+		select {
+		case ev := <-sub.queue:
 			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			if err := conn.WriteMessage(websocket.TextMessage, ev.data); err != nil {
+				conn.Close()
+				return
+			}
+		case <-sub.done:
+			if sub.evicted {
+				msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
 				conn.Close()
-				subscribers.Delete(conn)
 			}
-			return true
-		})
+			return
+		}
 	}
 }
 
@@ -152,7 +388,22 @@ func sanitizeFilename(name string) string {
 	return name
 }
 
-// validateWormholeCode checks if the code matches expected format
+// transferTypeName maps a wormhole transfer type to its API name
+func transferTypeName(t wormhole.TransferType) string {
+	switch t {
+	case wormhole.TransferText:
+		return "text"
+	case wormhole.TransferFile:
+		return "file"
+	case wormhole.TransferDirectory:
+		return "directory"
+	}
+	return ""
+}
+
+// validateWormholeCode checks if the code matches expected format. The
+// words are not checked against the wordlist: the CLI lets senders pick
+// any words with --code.
 func validateWormholeCode(code string) bool {
 	return wormholeCodePattern.MatchString(code)
 }
@@ -168,6 +419,9 @@ func (s *Server) startCleanupRoutine() {
 	go func() {
 		for range ticker.C {
 			s.cleanupOldTransfers()
+			if s.limiter != nil {
+				s.limiter.prune(time.Now())
+			}
 		}
 	}()
 }
@@ -176,25 +430,33 @@ func (s *Server) cleanupOldTransfers() {
 	now := time.Now()
 	var toDelete []string
 
-	s.transfers.Range(func(key, value any) bool {
-		id := key.(string)
-		transfer := value.(*TransferStatus)
-
+	s.store.Range(func(transfer *TransferStatus) bool {
 		// Only cleanup completed, errored, or expired transfers
 		age := now.Sub(transfer.CreatedAt)
 		if age > transferTTL {
-			toDelete = append(toDelete, id)
+			toDelete = append(toDelete, transfer.ID)
 		}
 		return true
 	})
 
 	for _, id := range toDelete {
+		// Stop anything still waiting on the mailbox
+		if transfer := s.getTransfer(id); transfer != nil && !transfer.finished() {
+			if transfer.cancel != nil {
+				transfer.cancel()
+			}
+			s.metrics.transferFailed(transfer, "expired")
+		}
+
 		// Remove temp files if they exist
 		transferDir := filepath.Join(s.tempDir, id)
 		os.RemoveAll(transferDir)
-		s.transfers.Delete(id)
-		log.Printf("Cleaned up expired transfer: %s", id)
+		s.deleteTransfer(id)
+		slog.Info("Cleaned up expired transfer", "transfer", id)
 	}
+
+	s.metrics.cleanupRuns.inc()
+	s.metrics.cleanupRemoved.add(float64(len(toDelete)))
 }
 
 // API Handlers
@@ -206,7 +468,9 @@ func (s *Server) handleSendText(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Text string `json:"text"`
+		Text   string `json:"text"`
+		Code   string `json:"code"`   // optional; empty asks the mailbox for one
+		Verify bool   `json:"verify"` // wait for the user to confirm the verifier
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -217,46 +481,59 @@ func (s *Server) handleSendText(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Text is required", http.StatusBadRequest)
 		return
 	}
+	code, err := s.checkSendCode(req.Code)
+	if err != nil {
+		writeSendCodeError(w, err)
+		return
+	}
+	req.Code = code
 
-	transferID := fmt.Sprintf("send-%d", time.Now().UnixNano())
+	transferID := newTransferID("send")
+	ctx, cancel := context.WithCancel(context.Background())
 	transfer := &TransferStatus{
 		ID:        transferID,
 		Type:      "send",
 		Status:    "sending",
+		Code:      req.Code,
+		Total:     int64(len(req.Text)),
+		Owner:     ownerOf(r),
 		CreatedAt: time.Now(),
+		cancel:    cancel,
+		log:       transferLogger(r, transferID),
 	}
-	s.setTransfer(transfer)
+	if req.Verify {
+		transfer.decision = make(chan bool, 1)
+	}
+	if err := s.setSendTransfer(transfer); err != nil {
+		cancel()
+		writeSendCodeError(w, err)
+		return
+	}
+	s.metrics.transferStarted(transfer)
+	decision := transfer.decision
 
+	// Text goes through the mailbox and never takes a transfer slot
 	go func() {
-		ctx := context.Background()
-		var c wormhole.Client
+		defer cancel()
+		c := s.newClient()
+		if decision != nil {
+			c.VerifierOk = s.verifyPeer(ctx, transferID, decision)
+		}
 
-		code, status, err := c.SendText(ctx, req.Text)
+		opts, claimed := s.sendCodeOptions(transferID, req.Code)
+		code, status, err := c.SendText(ctx, req.Text, opts...)
+		claimed()
 		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
+			s.failTransfer(ctx, transferID, err)
 			return
 		}
-
-		transfer.Code = code
-		transfer.Status = "waiting"
-		s.setTransfer(transfer)
+		s.sendWaiting(transferID, code)
 
 		// Wait for transfer to complete
-		result := <-status
-		if result.Error != nil {
-			transfer.Status = "error"
-			transfer.Error = result.Error.Error()
-		} else if result.OK {
-			transfer.Status = "complete"
-		}
-		s.setTransfer(transfer)
+		s.finishSend(ctx, transferID, status)
 	}()
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"id": transferID,
-	})
+	s.writeTransferCreated(w, r, transferID)
 }
 
 func (s *Server) handleSendFile(w http.ResponseWriter, r *http.Request) {
@@ -265,247 +542,294 @@ func (s *Server) handleSendFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form (max 500MB total)
-	if err := r.ParseMultipartForm(500 << 20); err != nil {
+	// Stream the form instead of buffering it with ParseMultipartForm
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.maxUploadSize())
+	mr, err := r.MultipartReader()
+	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
-	// Get all files from the form
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		// Fallback to single file field for backwards compatibility
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "At least one file is required", http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
-
-		// Single file - send directly
-		s.sendSingleFile(w, file, header)
-		return
-	}
-
-	// Multiple files or files with paths - create zip
-	s.sendMultipleFiles(w, r, files)
-}
-
-func (s *Server) sendSingleFile(w http.ResponseWriter, file multipart.File, header *multipart.FileHeader) {
-	safeFilename := sanitizeFilename(header.Filename)
-
-	transferID := fmt.Sprintf("send-%d", time.Now().UnixNano())
+	transferID := newTransferID("send")
 	transferDir := filepath.Join(s.tempDir, transferID)
 	if err := os.MkdirAll(transferDir, 0755); err != nil {
 		http.Error(w, "Failed to create temp directory", http.StatusInternalServerError)
 		return
 	}
 
-	tempPath := filepath.Join(transferDir, safeFilename)
-	dst, err := os.Create(tempPath)
+	up, err := streamUpload(mr, transferDir)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		os.RemoveAll(transferDir)
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxErr):
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errNoFiles):
+			http.Error(w, "At least one file is required", http.StatusBadRequest)
+		case errors.Is(err, errMixedUpload):
+			http.Error(w, "Use either file or files, not both", http.StatusBadRequest)
+		default:
+			http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	if _, err := io.Copy(dst, file); err != nil {
-		dst.Close()
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	switch up.fields["mode"] {
+	case "", "directory", "zip":
+	default:
+		os.RemoveAll(transferDir)
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
 		return
 	}
-	dst.Close()
-
-	transfer := &TransferStatus{
-		ID:        transferID,
-		Type:      "send",
-		Status:    "sending",
-		Filename:  safeFilename,
-		Total:     header.Size,
-		CreatedAt: time.Now(),
+	code, err := s.checkSendCode(up.fields["code"])
+	if err != nil {
+		os.RemoveAll(transferDir)
+		writeSendCodeError(w, err)
+		return
 	}
-	s.setTransfer(transfer)
+	up.fields["code"] = code
 
-	go func() {
-		defer os.RemoveAll(transferDir)
+	s.sendUpload(w, r, transferID, transferDir, up)
+}
+
+var (
+	errNoFiles     = errors.New("no files uploaded")
+	errMixedUpload = errors.New("both file and files fields uploaded")
+)
 
-		ctx := context.Background()
-		var c wormhole.Client
+// maxFieldSize caps the non-file form fields we hold in memory
+const maxFieldSize = 1 << 20
 
-		f, err := os.Open(tempPath)
-		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
-			return
+// upload is a file or zip archive that has been streamed to disk.
+type upload struct {
+	path    string // location inside the transfer directory
+	name    string // name offered to the receiver
+	size    int64
+	archive bool              // path is a zip of the "files" parts
+	fields  map[string]string // other form values
+}
+
+// streamUpload reads a multipart upload part by part, writing the single
+// "file" field or the zip of all "files" fields to dir exactly once. The
+// "paths" field must precede the files it describes.
+func streamUpload(mr *multipart.Reader, dir string) (*upload, error) {
+	var (
+		filePaths []string
+		single    *upload
+		zipFile   *os.File
+		zipWriter *zip.Writer
+		entries   []string
+		fields    = map[string]string{}
+	)
+	defer func() {
+		if zipFile != nil {
+			zipFile.Close()
 		}
-		defer f.Close()
+	}()
 
-		code, status, err := c.SendFile(ctx, safeFilename, f)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
-			return
+			return nil, err
 		}
 
-		transfer.Code = code
-		transfer.Status = "waiting"
-		s.setTransfer(transfer)
+		switch part.FormName() {
+		case "paths":
+			// Missing or malformed paths fall back to plain filenames
+			json.NewDecoder(io.LimitReader(part, maxFieldSize)).Decode(&filePaths)
 
-		result := <-status
-		if result.Error != nil {
-			transfer.Status = "error"
-			transfer.Error = result.Error.Error()
-		} else if result.OK {
-			transfer.Status = "complete"
-		}
-		s.setTransfer(transfer)
-	}()
+		case "file":
+			if single != nil || zipWriter != nil {
+				return nil, errMixedUpload
+			}
+			name := sanitizeFilename(part.FileName())
+			path := filepath.Join(dir, name)
+			size, err := writeFile(path, part)
+			if err != nil {
+				return nil, err
+			}
+			single = &upload{path: path, name: name, size: size}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"id": transferID,
-	})
-}
+		case "files":
+			if single != nil {
+				return nil, errMixedUpload
+			}
+			if zipWriter == nil {
+				zipFile, err = os.Create(filepath.Join(dir, "upload.zip"))
+				if err != nil {
+					return nil, err
+				}
+				zipWriter = zip.NewWriter(zipFile)
+			}
 
-func (s *Server) sendMultipleFiles(w http.ResponseWriter, r *http.Request, files []*multipart.FileHeader) {
-	transferID := fmt.Sprintf("send-%d", time.Now().UnixNano())
-	transferDir := filepath.Join(s.tempDir, transferID)
-	if err := os.MkdirAll(transferDir, 0755); err != nil {
-		http.Error(w, "Failed to create temp directory", http.StatusInternalServerError)
-		return
-	}
+			// Use provided path or just filename
+			var entryPath string
+			if i := len(entries); i < len(filePaths) && filePaths[i] != "" {
+				entryPath = sanitizePath(filePaths[i])
+			} else {
+				entryPath = sanitizeFilename(part.FileName())
+			}
+
+			zipEntry, err := zipWriter.Create(entryPath)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(zipEntry, part); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entryPath)
 
-	// Determine zip filename
-	zipName := "files.zip"
-	if len(files) == 1 {
-		// Check if it's a folder upload by looking at the path
-		if path := r.FormValue("paths"); path != "" {
-			// Use folder name if available
-			parts := strings.Split(path, "/")
-			if len(parts) > 0 && parts[0] != "" {
-				zipName = sanitizeFilename(parts[0]) + ".zip"
+		default:
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				return nil, err
 			}
+			fields[part.FormName()] = string(value)
 		}
+		part.Close()
 	}
 
-	// Get file paths if provided (for folder structure preservation)
-	pathsJSON := r.FormValue("paths")
-	var filePaths []string
-	if pathsJSON != "" {
-		json.Unmarshal([]byte(pathsJSON), &filePaths)
+	if single != nil {
+		single.fields = fields
+		return single, nil
+	}
+	if zipWriter == nil {
+		return nil, errNoFiles
 	}
 
-	// Create zip file
-	zipPath := filepath.Join(transferDir, zipName)
-	zipFile, err := os.Create(zipPath)
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	info, err := zipFile.Stat()
 	if err != nil {
-		http.Error(w, "Failed to create archive", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	zipWriter := zip.NewWriter(zipFile)
-	var totalSize int64
-
-	for i, fileHeader := range files {
-		file, err := fileHeader.Open()
-		if err != nil {
-			zipWriter.Close()
-			zipFile.Close()
-			http.Error(w, "Failed to read uploaded file", http.StatusInternalServerError)
-			return
-		}
+	return &upload{
+		path:    zipFile.Name(),
+		name:    zipArchiveName(entries),
+		size:    info.Size(),
+		archive: true,
+		fields:  fields,
+	}, nil
+}
 
-		// Use provided path or just filename
-		var entryPath string
-		if i < len(filePaths) && filePaths[i] != "" {
-			// Sanitize each path component
-			parts := strings.Split(filePaths[i], "/")
-			for j, part := range parts {
-				parts[j] = sanitizeFilename(part)
-			}
-			entryPath = strings.Join(parts, "/")
-		} else {
-			entryPath = sanitizeFilename(fileHeader.Filename)
-		}
+// writeFile copies r to a new file at path and returns the bytes written.
+func writeFile(path string, r io.Reader) (int64, error) {
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(dst, r)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
 
-		// Create entry in zip
-		zipEntry, err := zipWriter.Create(entryPath)
-		if err != nil {
-			file.Close()
-			zipWriter.Close()
-			zipFile.Close()
-			http.Error(w, "Failed to create archive entry", http.StatusInternalServerError)
-			return
-		}
+// sanitizePath sanitizes each component of a slash-separated relative path
+func sanitizePath(path string) string {
+	parts := strings.Split(path, "/")
+	for j, part := range parts {
+		parts[j] = sanitizeFilename(part)
+	}
+	return strings.Join(parts, "/")
+}
 
-		written, err := io.Copy(zipEntry, file)
-		file.Close()
-		if err != nil {
-			zipWriter.Close()
-			zipFile.Close()
-			http.Error(w, "Failed to write to archive", http.StatusInternalServerError)
-			return
+// zipArchiveName names the archive after the uploaded folder when every
+// entry lives under the same top-level directory.
+func zipArchiveName(entries []string) string {
+	var folder string
+	for _, entry := range entries {
+		top, _, found := strings.Cut(entry, "/")
+		if !found || (folder != "" && top != folder) {
+			return "files.zip"
 		}
-		totalSize += written
+		folder = top
 	}
+	if folder == "" {
+		return "files.zip"
+	}
+	return folder + ".zip"
+}
 
-	zipWriter.Close()
-	zipFile.Close()
-
-	// Get actual zip file size
-	zipInfo, _ := os.Stat(zipPath)
-	zipSize := zipInfo.Size()
-
+// sendUpload offers an uploaded file to the wormhole and responds with the
+// new transfer ID and its capability.
+func (s *Server) sendUpload(w http.ResponseWriter, r *http.Request, transferID, transferDir string, up *upload) {
+	ctx, cancel := context.WithCancel(context.Background())
 	transfer := &TransferStatus{
 		ID:        transferID,
 		Type:      "send",
 		Status:    "sending",
-		Filename:  zipName,
-		Total:     zipSize,
+		Code:      up.fields["code"],
+		Filename:  up.name,
+		Total:     up.size,
+		Owner:     ownerOf(r),
 		CreatedAt: time.Now(),
+		cancel:    cancel,
+		log:       transferLogger(r, transferID),
 	}
-	s.setTransfer(transfer)
+	if up.fields["verify"] == "true" {
+		transfer.decision = make(chan bool, 1)
+	}
+	if err := s.setSendTransfer(transfer); err != nil {
+		cancel()
+		os.RemoveAll(transferDir)
+		writeSendCodeError(w, err)
+		return
+	}
+	s.metrics.transferStarted(transfer)
+	log, decision := transfer.logger(), transfer.decision
 
 	go func() {
+		defer cancel()
 		defer os.RemoveAll(transferDir)
+		log.Debug("Upload saved", "filename", up.name, "bytes", up.size, "archive", up.archive)
 
-		ctx := context.Background()
-		var c wormhole.Client
+		var slot lazySlot
+		defer slot.done()
+		progress := s.sendProgress(ctx, transferID, &slot)
 
-		f, err := os.Open(zipPath)
-		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
-			return
+		c := s.newClient()
+		if decision != nil {
+			c.VerifierOk = s.verifyPeer(ctx, transferID, decision)
 		}
-		defer f.Close()
 
-		code, status, err := c.SendFile(ctx, zipName, f)
+		var (
+			code   string
+			status chan wormhole.SendResult
+			err    error
+		)
+		opts, claimed := s.sendCodeOptions(transferID, up.fields["code"])
+		opts = append(opts, progress)
+		if up.archive && up.fields["mode"] != "zip" {
+			code, status, err = s.sendDirectory(ctx, &c, transferID, up, opts...)
+		} else {
+			var f *os.File
+			f, err = os.Open(up.path)
+			if err != nil {
+				s.failTransfer(ctx, transferID, err)
+				return
+			}
+			defer f.Close()
+
+			code, status, err = c.SendFile(ctx, up.name, f, opts...)
+		}
+		claimed()
 		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
+			s.failTransfer(ctx, transferID, err)
 			return
 		}
+		s.sendWaiting(transferID, code)
 
-		transfer.Code = code
-		transfer.Status = "waiting"
-		s.setTransfer(transfer)
-
-		result := <-status
-		if result.Error != nil {
-			transfer.Status = "error"
-			transfer.Error = result.Error.Error()
-		} else if result.OK {
-			transfer.Status = "complete"
-		}
-		s.setTransfer(transfer)
+		// Wait for transfer to complete
+		s.finishSend(ctx, transferID, status)
 	}()
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"id": transferID,
-	})
+	s.writeTransferCreated(w, r, transferID)
 }
 
 func (s *Server) handleReceive(w http.ResponseWriter, r *http.Request) {
@@ -515,7 +839,8 @@ func (s *Server) handleReceive(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Code string `json:"code"`
+		Code   string `json:"code"`
+		Verify bool   `json:"verify"` // wait for the user to confirm the verifier
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -532,98 +857,157 @@ func (s *Server) handleReceive(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid wormhole code format", http.StatusBadRequest)
 		return
 	}
+	// The code is the password of the key exchange, which the other side
+	// typed in lowercase
+	req.Code = strings.ToLower(req.Code)
 
-	transferID := fmt.Sprintf("recv-%d", time.Now().UnixNano())
+	transferID := newTransferID("recv")
+	ctx, cancel := context.WithCancel(context.Background())
 	transfer := &TransferStatus{
 		ID:        transferID,
 		Type:      "receive",
 		Status:    "receiving",
 		Code:      req.Code,
+		Owner:     ownerOf(r),
 		CreatedAt: time.Now(),
+		cancel:    cancel,
+		decision:  make(chan bool, 1),
+		log:       transferLogger(r, transferID),
 	}
 	s.setTransfer(transfer)
+	s.metrics.transferStarted(transfer)
+	log, decision := transfer.logger(), transfer.decision
 
 	go func() {
-		ctx := context.Background()
-		var c wormhole.Client
+		defer cancel()
+		c := s.newClient()
+		if req.Verify {
+			c.VerifierOk = s.verifyPeer(ctx, transferID, decision)
+		}
 
 		msg, err := c.Receive(ctx, req.Code)
 		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
+			s.failTransfer(ctx, transferID, err)
 			return
 		}
 
 		// Sanitize received filename
 		safeFilename := sanitizeFilename(msg.Name)
-
-		transfer.Total = msg.TransferBytes64
-		transfer.Filename = safeFilename
-		s.setTransfer(transfer)
+		log.Info("Offer received",
+			"contentType", transferTypeName(msg.Type),
+			"filename", safeFilename,
+			"total", msg.TransferBytes64,
+			"files", msg.FileCount,
+		)
+
+		s.updateTransfer(transferID, func(t *TransferStatus) {
+			t.Total = msg.TransferBytes64
+			t.Filename = safeFilename
+			t.ContentType = transferTypeName(msg.Type)
+			t.FileCount = msg.FileCount
+		})
 
 		// Check if it's a text message
 		if msg.Type == wormhole.TransferText {
 			var buf bytes.Buffer
 			if _, err := io.Copy(&buf, msg); err != nil {
-				transfer.Status = "error"
-				transfer.Error = err.Error()
-				s.setTransfer(transfer)
+				s.failTransfer(ctx, transferID, err)
 				return
 			}
-			transfer.Status = "complete"
-			transfer.TextContent = buf.String()
-			transfer.Transferred = int64(buf.Len())
-			s.setTransfer(transfer)
+			s.completeTransfer(transferID, func(t *TransferStatus) {
+				t.TextContent = buf.String()
+				t.Transferred = int64(buf.Len())
+			})
 			return
 		}
 
+		// Hold the offer until the user decides whether to download it
+		s.updateTransfer(transferID, func(t *TransferStatus) {
+			t.Status = "offered"
+			drainDecision(decision)
+		})
+
+		select {
+		case accept := <-decision:
+			if !accept {
+				msg.Reject()
+				rejected, ok := s.updateTransfer(transferID, func(t *TransferStatus) {
+					t.Status = "rejected"
+				})
+				if ok {
+					s.metrics.transferFailed(rejected, "rejected")
+				}
+				return
+			}
+		case <-ctx.Done():
+			msg.Reject()
+			return
+		}
+
+		// Only accepted offers take a slot
+		release, err := s.acquireSlot(ctx, transferID)
+		if err != nil {
+			msg.Reject()
+			s.failTransfer(ctx, transferID, err)
+			return
+		}
+		defer release()
+
+		s.updateTransfer(transferID, func(t *TransferStatus) {
+			t.Status = "receiving"
+		})
+
 		// Save file to temp directory
 		transferDir := filepath.Join(s.tempDir, transferID)
 		if err := os.MkdirAll(transferDir, 0755); err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
+			s.failTransfer(ctx, transferID, err)
 			return
 		}
 
-		destPath := filepath.Join(transferDir, safeFilename)
+		// Directories arrive as a zip; keep it whole and list its contents
+		isDirectory := msg.Type == wormhole.TransferDirectory
+		destName := safeFilename
+		if isDirectory {
+			destName = directoryArchiveName(safeFilename)
+		}
+
+		destPath := filepath.Join(transferDir, destName)
 		f, err := os.Create(destPath)
 		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
+			s.failTransfer(ctx, transferID, err)
 			return
 		}
 
 		// Track progress while receiving
+		tracker := s.trackProgress(transferID)
 		written, err := io.Copy(f, &progressReader{
-			reader: msg,
-			onProgress: func(n int64) {
-				transfer.Transferred = n
-				transfer.Progress = float64(n) / float64(transfer.Total) * 100
-				s.setTransfer(transfer)
-			},
+			reader:     msg,
+			onProgress: tracker.transferred.Store,
 		})
 		f.Close()
 
 		if err != nil {
-			transfer.Status = "error"
-			transfer.Error = err.Error()
-			s.setTransfer(transfer)
+			s.failTransfer(ctx, transferID, err)
 			return
 		}
 
-		transfer.Status = "complete"
-		transfer.Transferred = written
-		transfer.Progress = 100
-		transfer.DownloadPath = fmt.Sprintf("/api/download/%s/%s", transferID, safeFilename)
-		s.setTransfer(transfer)
+		var files []FileEntry
+		if isDirectory {
+			files, err = listDirectoryArchive(destPath, transferID, safeFilename)
+			if err != nil {
+				s.failTransfer(ctx, transferID, err)
+				return
+			}
+		}
+
+		s.completeTransfer(transferID, func(t *TransferStatus) {
+			t.Files = files
+			t.Transferred = written
+			t.DownloadPath = fmt.Sprintf("/api/download/%s/%s", transferID, destName)
+		})
 	}()
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"id": transferID,
-	})
+	s.writeTransferCreated(w, r, transferID)
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -633,12 +1017,34 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validateTransferID(id) {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeTransfer(r, id) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
 	transfer := s.getTransfer(id)
 	if transfer == nil {
 		http.Error(w, "Transfer not found", http.StatusNotFound)
 		return
 	}
 
+	// Long poll: hold the request until there is something newer
+	if r.URL.Query().Has("wait") {
+		wait, since, err := parseStatusWait(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if transfer = s.waitForUpdate(r.Context(), id, since, wait); transfer == nil {
+			http.Error(w, "Transfer not found", http.StatusNotFound)
+			return
+		}
+	}
+
 	json.NewEncoder(w).Encode(transfer)
 }
 
@@ -654,6 +1060,10 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
 		return
 	}
+	if !s.authorizeTransfer(r, id) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
 
 	// Check if transfer exists
 	transfer := s.getTransfer(id)
@@ -663,30 +1073,134 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		loggerFrom(r.Context()).Warn("WebSocket upgrade failed", "err", err)
 		return
 	}
 	defer conn.Close()
+	s.wsConns.Add(1)
+	defer s.wsConns.Add(-1)
 
-	// Register subscriber
-	s.addSubscriber(id, conn)
-	defer s.removeSubscriber(id, conn)
-
-	// Send current status immediately
-	data, _ := json.Marshal(transfer)
-	conn.WriteMessage(websocket.TextMessage, data)
+	// Register subscriber; the current status goes out first
+	sub := s.subscribe(id)
+	defer s.events.unsubscribe(id, sub)
+	go writeEvents(conn, sub)
 
-	// Keep connection alive and handle client disconnect
+	// Keep connection alive, handle client commands and disconnect
 	for {
-		_, _, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			break
 		}
+
+		var msg wsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Action {
+		case "cancel":
+			s.cancelTransfer(id)
+		case "accept":
+			s.decideTransfer(id, true)
+		case "reject":
+			s.decideTransfer(id, false)
+		}
 	}
 }
 
+// handleTransferAction serves POST /api/transfers/{id}/accept and /reject.
+func (s *Server) handleTransferAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var accept bool
+	switch action {
+	case "accept":
+		accept = true
+	case "reject":
+		accept = false
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	switch err := s.decideTransfer(id, accept); err {
+	case nil:
+	case errTransferNotFound:
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	case errTransferNotOffered:
+		http.Error(w, "Transfer is not awaiting a decision", http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"id": id,
+	})
+}
+
+// wsMessage is a command sent by the client over /api/ws.
+type wsMessage struct {
+	Action string `json:"action"`
+}
+
+func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	// Parse /api/transfers/{transferID}[/{action}]
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/transfers/"), "/")
+	if !validateTransferID(id) {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeTransfer(r, id) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if action != "" {
+		s.handleTransferAction(w, r, id, action)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		switch err := s.cancelTransfer(id); err {
+		case nil:
+		case errTransferNotFound:
+			http.Error(w, "Transfer not found", http.StatusNotFound)
+			return
+		case errTransferFinished:
+			http.Error(w, "Transfer already finished", http.StatusConflict)
+			return
+		}
+		json.NewEncoder(w).Encode(s.getTransfer(id))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListTransfers serves GET /api/transfers, every transfer on the
+// server, oldest first.
+func (s *Server) handleListTransfers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	transfers := []*TransferStatus{}
+	s.store.Range(func(t *TransferStatus) bool {
+		transfers = append(transfers, t)
+		return true
+	})
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].CreatedAt.Before(transfers[j].CreatedAt)
+	})
+
+	json.NewEncoder(w).Encode(transfers)
+}
+
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 	// Parse /api/download/{transferID}/{filename}
 	path := r.URL.Path[len("/api/download/"):]
@@ -706,6 +1220,10 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
 		return
 	}
+	if !s.authorizeTransfer(r, transferID) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
 
 	// Sanitize filename to prevent path traversal
 	safeFilename := sanitizeFilename(filename)
@@ -721,6 +1239,13 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Received directories can also be fetched per entry or as tar.gz
+	if transfer.Type == "receive" && transfer.ContentType == "directory" && transfer.Status == "complete" {
+		if s.serveDirectoryDownload(w, r, transfer, filename) {
+			return
+		}
+	}
+
 	// Build the file path safely
 	filePath := filepath.Join(s.tempDir, transferID, safeFilename)
 
@@ -743,6 +1268,75 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filePath)
 }
 
+// sendDirectory offers an uploaded archive as a native wormhole directory
+// so CLI recipients get a folder instead of a zip file. Entries are read
+// back out of the upload zip; wormhole-william re-packs them itself.
+func (s *Server) sendDirectory(ctx context.Context, c *wormhole.Client, transferID string, up *upload, opts ...wormhole.SendOption) (string, chan wormhole.SendResult, error) {
+	zr, err := zip.OpenReader(up.path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dirName := strings.TrimSuffix(up.name, ".zip")
+	s.updateTransfer(transferID, func(t *TransferStatus) {
+		t.Filename = dirName
+		t.ContentType = "directory"
+		t.FileCount = len(zr.File)
+	})
+
+	entries := make([]wormhole.DirectoryEntry, 0, len(zr.File))
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		path := f.Name
+		if !strings.HasPrefix(path, dirName+"/") {
+			path = dirName + "/" + path
+		}
+		entries = append(entries, wormhole.DirectoryEntry{
+			Path:   path,
+			Mode:   0644,
+			Reader: f.Open,
+		})
+	}
+
+	// SendDirectory re-packs the entries into an archive of its own, already
+	// unlinked, before it returns. Drop ours so the wait for the receiver
+	// does not hold two copies on disk.
+	code, status, err := c.SendDirectory(ctx, dirName, entries, opts...)
+	zr.Close()
+	os.Remove(up.path)
+	return code, status, err
+}
+
+// sendProgress returns a send option that counts bytes handed to the
+// receiver, mirroring what progressReader does for receives. The first
+// bytes take a transfer slot, waiting for one if need be, and move the
+// transfer from waiting to sending. The library calls it from one
+// goroutine.
+func (s *Server) sendProgress(ctx context.Context, transferID string, slot *lazySlot) wormhole.SendOption {
+	var tracker *progressTracker
+	return wormhole.WithProgress(func(sent, total int64) {
+		if tracker == nil {
+			if err := slot.acquire(ctx, s, transferID); err != nil {
+				if errors.Is(err, errQueueFull) {
+					s.abortTransfer(transferID, err)
+				}
+				return
+			}
+			s.updateTransfer(transferID, func(t *TransferStatus) {
+				if t.Status == "waiting" || t.Status == "queued" {
+					t.Status = "sending"
+				}
+			})
+			tracker = s.trackProgress(transferID)
+		}
+		// Directory sends only learn their size once re-packed
+		tracker.total.Store(total)
+		tracker.transferred.Store(sent)
+	})
+}
+
 type progressReader struct {
 	reader     io.Reader
 	onProgress func(int64)
@@ -758,42 +1352,147 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// routes sets up the HTTP router.
+func (s *Server) routes() (http.Handler, error) {
+	mux := http.NewServeMux()
+
+	// API routes, all behind authentication
+	api := http.NewServeMux()
+	api.HandleFunc("/api/send/text", s.requirePermission(permSend, s.requireCSRF(s.limitTransfers(s.handleSendText))))
+	api.HandleFunc("/api/send/file", s.requirePermission(permSend, s.requireCSRF(s.limitTransfers(s.handleSendFile))))
+	api.HandleFunc("/api/receive", s.requirePermission(permReceive, s.requireCSRF(s.limitTransfers(s.handleReceive))))
+	api.HandleFunc("/api/status", s.handleStatus)
+	api.HandleFunc("/api/ws", s.handleWebSocket)
+	api.HandleFunc("/api/events", s.handleEvents)
+	api.HandleFunc("/api/download/", s.handleDownload)
+	api.HandleFunc("/api/transfers", s.requirePermission(permAdmin, s.handleListTransfers))
+	api.HandleFunc("/api/limits", s.requirePermission(permAdmin, s.handleLimits))
+	api.HandleFunc("/api/transfers/", s.handleTransfer)
+	api.HandleFunc("/api/config", s.handleConfig)
+	api.HandleFunc("/api/codes/complete", s.handleCompleteCode)
+	api.HandleFunc("/api/me", s.handleMe)
+	api.HandleFunc("/api/csrf", s.handleCSRF)
+	api.HandleFunc("/api/version", s.handleVersion)
+	mux.Handle("/api/", s.requireAuth(api))
+	mux.Handle("/metrics", s.requireAuth(http.HandlerFunc(s.handleMetrics)))
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+
+	// Serve static files from embedded filesystem
+	staticFS, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		return nil, err
+	}
+	var static http.Handler = http.FileServer(http.FS(staticFS))
+
+	if s.oidc != nil {
+		mux.HandleFunc("/auth/login", s.oidc.handleLogin)
+		mux.HandleFunc("/auth/callback", s.oidc.handleCallback)
+		mux.HandleFunc("/auth/logout", s.oidc.handleLogout)
+		static = s.requireLogin(static)
+	}
+	mux.Handle("/", static)
+
+	return withRequestID(mux), nil
+}
+
 func main() {
-	server := NewServer()
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	logger, err := newLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	var mailboxHTTP *http.Server
+	if cfg.ServeMailbox != "" {
+		var mailboxURL string
+		mailboxHTTP, mailboxURL, err = startMailboxServer(cfg.ServeMailbox)
+		if err != nil {
+			fatal("Failed to start mailbox server", "err", err)
+		}
+		slog.Info("Serving rendezvous mailbox", "addr", cfg.ServeMailbox)
+		if cfg.RendezvousURL == "" {
+			cfg.RendezvousURL = mailboxURL
+		}
+	}
+
+	var relay *transitRelay
+	if cfg.ServeTransit != "" || cfg.ServeTransitWS != "" {
+		relay = newTransitRelay(cfg.TransitMaxRate, cfg.TransitMaxBytes)
+		if cfg.ServeTransitWS != "" {
+			if err := relay.listenWebSocket(cfg.ServeTransitWS); err != nil {
+				fatal("Failed to start transit relay", "err", err)
+			}
+			slog.Info("Serving transit relay to WebSocket peers", "addr", cfg.ServeTransitWS)
+		}
+		if cfg.ServeTransit != "" {
+			host := cfg.transitAdvertiseHost()
+			relayAddr, err := relay.listenTCP(cfg.ServeTransit, host)
+			if err != nil {
+				fatal("Failed to start transit relay", "err", err)
+			}
+			slog.Info("Serving transit relay", "addr", cfg.ServeTransit, "advertised", relayAddr)
+			if host == "" {
+				slog.Warn("Advertising a detected transit relay address; set -transit-advertise-host if peers cannot reach it", "advertised", relayAddr)
+			}
+			if cfg.TransitRelayURL == "" {
+				cfg.TransitRelayURL = relayAddr
+			}
+		}
+	}
+
+	server := NewServer(cfg)
+	server.relay = relay
+	if cfg.DataDir != "" {
+		if err := server.openDataDir(cfg.DataDir); err != nil {
+			fatal("Failed to open data dir", "err", err)
+		}
+		slog.Info("Persisting transfers", "dir", cfg.DataDir)
+	}
+
+	// Auth comes after the data dir, which holds the session signing key
+	server.auth, err = newAuthenticators(cfg)
+	if err != nil {
+		fatal("Invalid auth configuration", "err", err)
+	}
+	if cfg.OIDCIssuer != "" {
+		server.oidc, err = newOIDCProvider(context.Background(), cfg, server.secret)
+		if err != nil {
+			fatal("Failed to set up OIDC", "err", err)
+		}
+		server.auth = append(server.auth, server.oidc)
+		slog.Info("OIDC login enabled", "issuer", cfg.OIDCIssuer)
+	}
+	if len(server.auth) == 0 {
+		slog.Warn("Authentication disabled; anyone who can reach the server can use it")
+	}
 
 	// Ensure temp directory exists
 	os.MkdirAll(server.tempDir, 0755)
+	// wormhole-william stages directory sends in os.TempDir; keep them on
+	// the disk the data dir and the free space check cover
+	os.Setenv("TMPDIR", server.tempDir)
 
 	// Start cleanup routine for expired transfers
 	server.startCleanupRoutine()
 
-	// Set up router
-	mux := http.NewServeMux()
-
-	// API routes
-	mux.HandleFunc("/api/send/text", server.handleSendText)
-	mux.HandleFunc("/api/send/file", server.handleSendFile)
-	mux.HandleFunc("/api/receive", server.handleReceive)
-	mux.HandleFunc("/api/status", server.handleStatus)
-	mux.HandleFunc("/api/ws", server.handleWebSocket)
-	mux.HandleFunc("/api/download/", server.handleDownload)
-
-	// Serve static files from embedded filesystem
-	staticFS, err := fs.Sub(staticFiles, "static")
+	handler, err := server.routes()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to set up routes", "err", err)
 	}
-	mux.Handle("/", http.FileServer(http.FS(staticFS)))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	port := cfg.Port
 
 	httpServer := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: handler,
 	}
+	// Event streams and long polls would otherwise hold Shutdown up
+	httpServer.RegisterOnShutdown(server.events.closeAll)
 
 	// Channel to listen for shutdown signals
 	quit := make(chan os.Signal, 1)
@@ -801,15 +1500,23 @@ func main() {
 
 	// Start server in goroutine
 	go func() {
-		log.Printf("Starting wormhole-web server on port %s", port)
+		slog.Info("Starting wormhole-web server", "port", port)
+		if cfg.RendezvousURL != "" {
+			slog.Info("Using rendezvous server", "url", cfg.RendezvousURL)
+		}
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+			fatal("Server error", "err", err)
 		}
 	}()
 
 	// Wait for shutdown signal
 	<-quit
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server", "drainTimeout", cfg.DrainTimeout)
+
+	// Let active transfers finish while status and downloads keep working
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	server.drain(drainCtx)
+	cancelDrain()
 
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
@@ -817,10 +1524,21 @@ func main() {
 
 	// Attempt graceful shutdown
 	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		slog.Warn("Server forced to shutdown", "err", err)
+	}
+	if mailboxHTTP != nil {
+		mailboxHTTP.Shutdown(ctx)
+	}
+	if relay != nil {
+		relay.Close()
+	}
+	if closer, ok := server.store.(io.Closer); ok {
+		closer.Close()
 	}
 
-	// Clean up temp directory
-	os.RemoveAll(server.tempDir)
-	log.Println("Server stopped")
+	// Clean up temp directory unless downloads should survive a restart
+	if cfg.DataDir == "" {
+		os.RemoveAll(server.tempDir)
+	}
+	slog.Info("Server stopped")
 }
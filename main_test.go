@@ -1,9 +1,12 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -12,6 +15,16 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// Well-formed transfer IDs for handler tests
+const (
+	testSendID = "send-5f2b8c1e9a7d4e3f8b6a0c2d1e4f7a9b"
+	testRecvID = "recv-9c4e1a7b3d2f8e6a5b0c4d7e1f2a3b8c"
 )
 
 // ============================================================
@@ -27,12 +40,15 @@ func TestValidateWormholeCode(t *testing.T) {
 		{"valid code", "7-guitarist-revenge", true},
 		{"valid code with numbers", "123-hello-world", true},
 		{"valid code single digit", "1-foo-bar", true},
+		{"one word", "7-guitarist", true},
+		{"more words", "7-guitarist-revenge-tobacco-uproot", true},
+		{"words off the wordlist", "42-release-bundle", true},
 		{"empty string", "", false},
 		{"missing number", "guitarist-revenge", false},
+		{"missing words", "7", false},
 		{"missing first word", "7--revenge", false},
 		{"missing second word", "7-guitarist-", false},
-		{"too many parts", "7-guitarist-revenge-extra", false},
-		{"numbers in words", "7-guitar1st-revenge", false},
+		{"numbers in words", "7-guitar1st-revenge", true},
 		{"special characters", "7-guitarist-revenge!", false},
 		{"spaces", "7-guitarist revenge", false},
 		{"uppercase", "7-GUITARIST-REVENGE", true},
@@ -55,15 +71,18 @@ func TestValidateTransferID(t *testing.T) {
 		id    string
 		valid bool
 	}{
-		{"valid send ID", "send-1234567890", true},
-		{"valid recv ID", "recv-9876543210", true},
+		{"valid send ID", testSendID, true},
+		{"valid recv ID", testRecvID, true},
+		{"generated ID", newTransferID("send"), true},
 		{"empty string", "", false},
-		{"missing prefix", "1234567890", false},
-		{"wrong prefix", "upload-1234567890", false},
-		{"missing timestamp", "send-", false},
-		{"non-numeric timestamp", "send-abc", false},
-		{"spaces", "send- 123", false},
-		{"path traversal attempt", "send-123/../../../etc/passwd", false},
+		{"missing prefix", "5f2b8c1e9a7d4e3f8b6a0c2d1e4f7a9b", false},
+		{"wrong prefix", "upload-5f2b8c1e9a7d4e3f8b6a0c2d1e4f7a9b", false},
+		{"missing random part", "send-", false},
+		{"timestamp", "send-1234567890", false},
+		{"too short", "send-5f2b8c1e9a7d4e3f", false},
+		{"uppercase hex", "send-5F2B8C1E9A7D4E3F8B6A0C2D1E4F7A9B", false},
+		{"spaces", "send- 5f2b8c1e9a7d4e3f8b6a0c2d1e4f7a9", false},
+		{"path traversal attempt", "send-5f2b8c1e9a7d4e3f8b6a0c2d1e4f7a9b/../../../etc/passwd", false},
 	}
 
 	for _, tt := range tests {
@@ -130,11 +149,11 @@ func TestSanitizeFilenameTruncation(t *testing.T) {
 // ============================================================
 
 func TestServerTransferManagement(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	// Test setTransfer and getTransfer
 	transfer := &TransferStatus{
-		ID:        "send-123456789",
+		ID:        testSendID,
 		Type:      "send",
 		Status:    "waiting",
 		Code:      "7-test-code",
@@ -143,7 +162,7 @@ func TestServerTransferManagement(t *testing.T) {
 
 	server.setTransfer(transfer)
 
-	got := server.getTransfer("send-123456789")
+	got := server.getTransfer(testSendID)
 	if got == nil {
 		t.Fatal("getTransfer returned nil for existing transfer")
 	}
@@ -161,8 +180,8 @@ func TestServerTransferManagement(t *testing.T) {
 	}
 
 	// Test deleteTransfer
-	server.deleteTransfer("send-123456789")
-	deleted := server.getTransfer("send-123456789")
+	server.deleteTransfer(testSendID)
+	deleted := server.getTransfer(testSendID)
 	if deleted != nil {
 		t.Error("getTransfer should return nil after deleteTransfer")
 	}
@@ -173,7 +192,7 @@ func TestServerTransferManagement(t *testing.T) {
 // ============================================================
 
 func TestHandleSendTextMethodNotAllowed(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/send/text", nil)
 	w := httptest.NewRecorder()
@@ -186,7 +205,7 @@ func TestHandleSendTextMethodNotAllowed(t *testing.T) {
 }
 
 func TestHandleSendTextEmptyBody(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	body := strings.NewReader(`{"text":""}`)
 	req := httptest.NewRequest(http.MethodPost, "/api/send/text", body)
@@ -201,7 +220,7 @@ func TestHandleSendTextEmptyBody(t *testing.T) {
 }
 
 func TestHandleSendTextInvalidJSON(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	body := strings.NewReader(`not json`)
 	req := httptest.NewRequest(http.MethodPost, "/api/send/text", body)
@@ -216,7 +235,7 @@ func TestHandleSendTextInvalidJSON(t *testing.T) {
 }
 
 func TestHandleReceiveMethodNotAllowed(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/receive", nil)
 	w := httptest.NewRecorder()
@@ -229,7 +248,7 @@ func TestHandleReceiveMethodNotAllowed(t *testing.T) {
 }
 
 func TestHandleReceiveEmptyCode(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	body := strings.NewReader(`{"code":""}`)
 	req := httptest.NewRequest(http.MethodPost, "/api/receive", body)
@@ -244,7 +263,7 @@ func TestHandleReceiveEmptyCode(t *testing.T) {
 }
 
 func TestHandleReceiveInvalidCodeFormat(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	body := strings.NewReader(`{"code":"invalid-code"}`)
 	req := httptest.NewRequest(http.MethodPost, "/api/receive", body)
@@ -259,7 +278,7 @@ func TestHandleReceiveInvalidCodeFormat(t *testing.T) {
 }
 
 func TestHandleStatusMissingID(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
 	w := httptest.NewRecorder()
@@ -272,9 +291,9 @@ func TestHandleStatusMissingID(t *testing.T) {
 }
 
 func TestHandleStatusNotFound(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
-	req := httptest.NewRequest(http.MethodGet, "/api/status?id=send-nonexistent", nil)
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/status?id="+testSendID, nil), testSendID)
 	w := httptest.NewRecorder()
 
 	server.handleStatus(w, req)
@@ -285,11 +304,11 @@ func TestHandleStatusNotFound(t *testing.T) {
 }
 
 func TestHandleStatusSuccess(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	// Create a transfer first
 	transfer := &TransferStatus{
-		ID:        "send-123456789",
+		ID:        testSendID,
 		Type:      "send",
 		Status:    "waiting",
 		Code:      "7-test-code",
@@ -297,7 +316,7 @@ func TestHandleStatusSuccess(t *testing.T) {
 	}
 	server.setTransfer(transfer)
 
-	req := httptest.NewRequest(http.MethodGet, "/api/status?id=send-123456789", nil)
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/status?id="+testSendID, nil), testSendID)
 	w := httptest.NewRecorder()
 
 	server.handleStatus(w, req)
@@ -320,7 +339,7 @@ func TestHandleStatusSuccess(t *testing.T) {
 }
 
 func TestHandleDownloadInvalidPath(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/download/invalidpath", nil)
 	w := httptest.NewRecorder()
@@ -333,7 +352,7 @@ func TestHandleDownloadInvalidPath(t *testing.T) {
 }
 
 func TestHandleDownloadInvalidTransferID(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/download/invalid-id/file.txt", nil)
 	w := httptest.NewRecorder()
@@ -346,9 +365,9 @@ func TestHandleDownloadInvalidTransferID(t *testing.T) {
 }
 
 func TestHandleDownloadTransferNotFound(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
-	req := httptest.NewRequest(http.MethodGet, "/api/download/recv-123456789/file.txt", nil)
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/download/"+testRecvID+"/file.txt", nil), testRecvID)
 	w := httptest.NewRecorder()
 
 	server.handleDownload(w, req)
@@ -359,11 +378,11 @@ func TestHandleDownloadTransferNotFound(t *testing.T) {
 }
 
 func TestHandleDownloadPathTraversal(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	// Create a transfer
 	transfer := &TransferStatus{
-		ID:        "recv-123456789",
+		ID:        testRecvID,
 		Type:      "receive",
 		Status:    "complete",
 		CreatedAt: time.Now(),
@@ -371,7 +390,7 @@ func TestHandleDownloadPathTraversal(t *testing.T) {
 	server.setTransfer(transfer)
 
 	// Attempt path traversal
-	req := httptest.NewRequest(http.MethodGet, "/api/download/recv-123456789/../../../etc/passwd", nil)
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/download/"+testRecvID+"/../../../etc/passwd", nil), testRecvID)
 	w := httptest.NewRecorder()
 
 	server.handleDownload(w, req)
@@ -384,7 +403,7 @@ func TestHandleDownloadPathTraversal(t *testing.T) {
 }
 
 func TestHandleSendFileMethodNotAllowed(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/send/file", nil)
 	w := httptest.NewRecorder()
@@ -397,7 +416,7 @@ func TestHandleSendFileMethodNotAllowed(t *testing.T) {
 }
 
 func TestHandleSendFileNoFile(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	// Create empty multipart form
 	body := &bytes.Buffer{}
@@ -475,7 +494,7 @@ func TestProgressReader(t *testing.T) {
 // ============================================================
 
 func TestCleanupOldTransfers(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	// Create temp directory for testing
 	testDir := filepath.Join(os.TempDir(), "wormhole-web-test")
@@ -530,7 +549,7 @@ func TestCleanupOldTransfers(t *testing.T) {
 // ============================================================
 
 func TestNewServer(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	if server == nil {
 		t.Fatal("NewServer returned nil")
@@ -551,7 +570,7 @@ func TestNewServer(t *testing.T) {
 // ============================================================
 
 func TestHandleWebSocketMissingID(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/ws", nil)
 	w := httptest.NewRecorder()
@@ -564,7 +583,7 @@ func TestHandleWebSocketMissingID(t *testing.T) {
 }
 
 func TestHandleWebSocketInvalidID(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/ws?id=invalid", nil)
 	w := httptest.NewRecorder()
@@ -577,9 +596,9 @@ func TestHandleWebSocketInvalidID(t *testing.T) {
 }
 
 func TestHandleWebSocketTransferNotFound(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
-	req := httptest.NewRequest(http.MethodGet, "/api/ws?id=send-123456789", nil)
+	req := withCapability(server, httptest.NewRequest(http.MethodGet, "/api/ws?id="+testSendID, nil), testSendID)
 	w := httptest.NewRecorder()
 
 	server.handleWebSocket(w, req)
@@ -594,11 +613,11 @@ func TestHandleWebSocketTransferNotFound(t *testing.T) {
 // ============================================================
 
 func TestSubscriberManagement(t *testing.T) {
-	server := NewServer()
+	server := NewServer(Config{})
 
 	// Test that subscribers map starts empty
 	transfer := &TransferStatus{
-		ID:        "send-123",
+		ID:        testSendID,
 		Type:      "send",
 		Status:    "waiting",
 		CreatedAt: time.Now(),
@@ -608,3 +627,580 @@ func TestSubscriberManagement(t *testing.T) {
 	// Notify with no subscribers should not panic
 	server.notifySubscribers(transfer)
 }
+
+// ============================================================
+// CANCELLATION TESTS
+// ============================================================
+
+func TestCancelTransfer(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transfer := &TransferStatus{
+		ID:        testRecvID,
+		Type:      "receive",
+		Status:    "receiving",
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	}
+	server.setTransfer(transfer)
+
+	transferDir := filepath.Join(server.tempDir, transfer.ID)
+	os.MkdirAll(transferDir, 0755)
+
+	if err := server.cancelTransfer(transfer.ID); err != nil {
+		t.Fatalf("cancelTransfer: %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Error("cancelTransfer should cancel the transfer context")
+	}
+	if got := server.getTransfer(transfer.ID).Status; got != "cancelled" {
+		t.Errorf("Status = %q, want %q", got, "cancelled")
+	}
+	if _, err := os.Stat(transferDir); !os.IsNotExist(err) {
+		t.Error("cancelTransfer should remove the transfer directory")
+	}
+
+	// Errors reported after cancellation must not overwrite the status
+	server.failTransfer(ctx, transfer.ID, context.Canceled)
+	if got := server.getTransfer(transfer.ID).Status; got != "cancelled" {
+		t.Errorf("Status after late error = %q, want %q", got, "cancelled")
+	}
+
+	if err := server.cancelTransfer(transfer.ID); err != errTransferFinished {
+		t.Errorf("second cancelTransfer = %v, want %v", err, errTransferFinished)
+	}
+	if err := server.cancelTransfer(newTransferID("recv")); err != errTransferNotFound {
+		t.Errorf("cancelTransfer unknown = %v, want %v", err, errTransferNotFound)
+	}
+}
+
+func TestHandleTransferDelete(t *testing.T) {
+	server := NewServer(Config{})
+	_, cancel := context.WithCancel(context.Background())
+	server.setTransfer(&TransferStatus{
+		ID:        testSendID,
+		Type:      "send",
+		Status:    "waiting",
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"invalid ID", http.MethodDelete, "/api/transfers/nope", http.StatusBadRequest},
+		{"not found", http.MethodDelete, "/api/transfers/" + testRecvID, http.StatusNotFound},
+		{"wrong method", http.MethodGet, "/api/transfers/" + testSendID, http.StatusMethodNotAllowed},
+		{"cancel", http.MethodDelete, "/api/transfers/" + testSendID, http.StatusOK},
+		{"already cancelled", http.MethodDelete, "/api/transfers/" + testSendID, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := strings.TrimPrefix(tt.path, "/api/transfers/")
+			req := withCapability(server, httptest.NewRequest(tt.method, tt.path, nil), id)
+			w := httptest.NewRecorder()
+
+			server.handleTransfer(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("handleTransfer %s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketCancel(t *testing.T) {
+	server := NewServer(Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	server.setTransfer(&TransferStatus{
+		ID:        testSendID,
+		Type:      "send",
+		Status:    "waiting",
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws?id=" + testSendID
+	header := http.Header{"Authorization": {"Bearer " + server.capability(testSendID)}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Initial status
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	conn.WriteJSON(wsMessage{Action: "cancel"})
+
+	var status TransferStatus
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&status); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if status.Status != "cancelled" {
+		t.Errorf("Status = %q, want %q", status.Status, "cancelled")
+	}
+	if ctx.Err() == nil {
+		t.Error("cancel message should cancel the transfer context")
+	}
+}
+
+// ============================================================
+// END-TO-END RECEIVE TESTS
+// ============================================================
+
+// newTestRendezvous starts an in-process mailbox server and returns a
+// config pointing at it. Transit relaying is disabled so peers connect
+// directly.
+func newTestRendezvous(t *testing.T) Config {
+	t.Helper()
+	rs := rendezvousservertest.NewServer()
+	t.Cleanup(rs.Close)
+
+	relay := wormhole.DefaultTransitRelayAddress
+	wormhole.DefaultTransitRelayAddress = ""
+	t.Cleanup(func() { wormhole.DefaultTransitRelayAddress = relay })
+
+	return Config{RendezvousURL: rs.WebSocketURL()}
+}
+
+// waitForStatus polls a transfer until it reaches the wanted status.
+func waitForStatus(t *testing.T, server *Server, id, status string) *TransferStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if transfer := server.getTransfer(id); transfer != nil && transfer.Status == status {
+			return transfer
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("transfer %s never reached status %q (last: %+v)", id, status, server.getTransfer(id))
+	return nil
+}
+
+// startReceive posts a code to handleReceive and returns the transfer ID.
+func startReceive(t *testing.T, server *Server, code string) string {
+	t.Helper()
+	body := strings.NewReader(`{"code":"` + code + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/receive", body)
+	w := httptest.NewRecorder()
+
+	server.handleReceive(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleReceive: got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.ID
+}
+
+func TestReceiveOfferAccept(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	sender := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	content := []byte("offered content")
+	code, result, err := sender.SendFile(context.Background(), "report.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+
+	id := startReceive(t, server, code)
+	offer := waitForStatus(t, server, id, "offered")
+	if offer.Filename != "report.txt" || offer.Total != int64(len(content)) {
+		t.Errorf("offer = %q (%d bytes), want %q (%d bytes)", offer.Filename, offer.Total, "report.txt", len(content))
+	}
+	if offer.ContentType != "file" || offer.FileCount != 1 {
+		t.Errorf("offer type = %q, files = %d", offer.ContentType, offer.FileCount)
+	}
+
+	// Nothing should be written until the offer is accepted
+	if _, err := os.Stat(filepath.Join(server.tempDir, id)); !os.IsNotExist(err) {
+		t.Error("offered transfer should not touch the disk")
+	}
+
+	req := withCapability(server, httptest.NewRequest(http.MethodPost, "/api/transfers/"+id+"/accept", nil), id)
+	w := httptest.NewRecorder()
+	server.handleTransfer(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("accept: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	waitForStatus(t, server, id, "complete")
+	got, err := os.ReadFile(filepath.Join(server.tempDir, id, "report.txt"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("received file = %q, %v; want %q", got, err, content)
+	}
+	if r := <-result; !r.OK {
+		t.Errorf("sender result = %+v", r)
+	}
+
+	// A second decision is a conflict
+	w = httptest.NewRecorder()
+	server.handleTransfer(w, withCapability(server, httptest.NewRequest(http.MethodPost, "/api/transfers/"+id+"/reject", nil), id))
+	if w.Code != http.StatusConflict {
+		t.Errorf("late reject: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestReceiveOfferReject(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	sender := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	code, result, err := sender.SendFile(context.Background(), "huge.iso", bytes.NewReader(make([]byte, 1<<16)))
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+
+	id := startReceive(t, server, code)
+	waitForStatus(t, server, id, "offered")
+
+	if err := server.decideTransfer(id, false); err != nil {
+		t.Fatalf("decideTransfer: %v", err)
+	}
+
+	waitForStatus(t, server, id, "rejected")
+	select {
+	case r := <-result:
+		if r.Error == nil || !strings.Contains(r.Error.Error(), "rejected") {
+			t.Errorf("sender result = %+v, want rejection", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender never saw the rejection")
+	}
+}
+
+// ============================================================
+// END-TO-END SEND TESTS
+// ============================================================
+
+// multipartBody builds a multipart upload with the given form files.
+func multipartBody(t *testing.T, field string, files map[string][]byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, content := range files {
+		part, err := writer.CreateFormFile(field, name)
+		if err != nil {
+			t.Fatalf("CreateFormFile: %v", err)
+		}
+		part.Write(content)
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+// startSend posts to handleSendFile and returns the transfer ID.
+func startSend(t *testing.T, server *Server, body io.Reader, contentType string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/send/file", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	server.handleSendFile(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleSendFile: got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.ID
+}
+
+func TestSendFileProgress(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1 MiB
+	body, contentType := multipartBody(t, "file", map[string][]byte{"big.bin": content})
+	id := startSend(t, server, body, contentType)
+
+	code := waitForStatus(t, server, id, "waiting").Code
+
+	receiver := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	msg, err := receiver.Receive(context.Background(), code)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+
+	// After the first byte arrives the sender must already report progress
+	if _, err := msg.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.getTransfer(id).Transferred == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("send progress was never reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := server.getTransfer(id).Status; got != "sending" {
+		t.Errorf("Status during transfer = %q, want %q", got, "sending")
+	}
+
+	io.Copy(io.Discard, msg)
+	done := waitForStatus(t, server, id, "complete")
+	if done.Transferred != int64(len(content)) || done.Progress != 100 {
+		t.Errorf("final progress = %d bytes, %.0f%%; want %d bytes, 100%%", done.Transferred, done.Progress, len(content))
+	}
+}
+
+// ============================================================
+// STREAMING UPLOAD TESTS
+// ============================================================
+
+func TestStreamUploadZip(t *testing.T) {
+	dir := t.TempDir()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("paths", `["photos/a.jpg","photos/../../b.jpg"]`)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		part, _ := writer.CreateFormFile("files", name)
+		part.Write([]byte("content of " + name))
+	}
+	writer.Close()
+
+	up, err := streamUpload(multipart.NewReader(body, writer.Boundary()), dir)
+	if err != nil {
+		t.Fatalf("streamUpload: %v", err)
+	}
+	if up.name != "photos.zip" {
+		t.Errorf("name = %q, want %q", up.name, "photos.zip")
+	}
+
+	info, err := os.Stat(up.path)
+	if err != nil || info.Size() != up.size {
+		t.Fatalf("zip on disk = %v, %v; want %d bytes", info, err, up.size)
+	}
+
+	zr, err := zip.OpenReader(up.path)
+	if err != nil {
+		t.Fatalf("zip.OpenReader: %v", err)
+	}
+	defer zr.Close()
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"photos/a.jpg", "photos/unnamed/unnamed/b.jpg"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("zip entries = %v, want %v", names, want)
+	}
+
+	// Only the archive is kept; no per-file copies
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("upload left %d files on disk, want 1", len(files))
+	}
+}
+
+func TestStreamUploadSingle(t *testing.T) {
+	dir := t.TempDir()
+	body, contentType := multipartBody(t, "file", map[string][]byte{"../notes.txt": []byte("hello")})
+	_, params, _ := mime.ParseMediaType(contentType)
+
+	up, err := streamUpload(multipart.NewReader(body, params["boundary"]), dir)
+	if err != nil {
+		t.Fatalf("streamUpload: %v", err)
+	}
+	if up.name != "notes.txt" || up.size != 5 {
+		t.Errorf("upload = %q (%d bytes), want %q (5 bytes)", up.name, up.size, "notes.txt")
+	}
+	if up.path != filepath.Join(dir, "notes.txt") {
+		t.Errorf("path = %q", up.path)
+	}
+}
+
+func TestZipArchiveName(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    string
+	}{
+		{[]string{"a.txt", "b.txt"}, "files.zip"},
+		{[]string{"docs/a.txt", "docs/sub/b.txt"}, "docs.zip"},
+		{[]string{"docs/a.txt", "other/b.txt"}, "files.zip"},
+		{[]string{"docs/a.txt", "b.txt"}, "files.zip"},
+	}
+
+	for _, tt := range tests {
+		if got := zipArchiveName(tt.entries); got != tt.want {
+			t.Errorf("zipArchiveName(%v) = %q, want %q", tt.entries, got, tt.want)
+		}
+	}
+}
+
+func TestHandleSendFileTooLarge(t *testing.T) {
+	server := NewServer(Config{MaxUploadSize: 1024})
+	server.tempDir = t.TempDir()
+
+	body, contentType := multipartBody(t, "file", map[string][]byte{"big.bin": make([]byte, 4096)})
+	req := httptest.NewRequest(http.MethodPost, "/api/send/file", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	server.handleSendFile(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("handleSendFile too large: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// The partial upload must be cleaned up
+	if entries, _ := os.ReadDir(server.tempDir); len(entries) != 0 {
+		t.Errorf("rejected upload left %d entries in temp dir", len(entries))
+	}
+}
+
+func TestHandleSendFileMixedFields(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "a.txt")
+	part.Write([]byte("a"))
+	part, _ = writer.CreateFormFile("files", "b.txt")
+	part.Write([]byte("b"))
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/send/file", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	server.handleSendFile(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("handleSendFile mixed fields: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// ============================================================
+// DIRECTORY SEND TESTS
+// ============================================================
+
+// folderUpload builds a folder upload with an optional mode field.
+func folderUpload(t *testing.T, mode string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if mode != "" {
+		writer.WriteField("mode", mode)
+	}
+	writer.WriteField("paths", `["album/a.txt","album/sub/b.txt"]`)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		part, _ := writer.CreateFormFile("files", name)
+		part.Write([]byte("content of " + name))
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+// receiveAll receives code with a plain wormhole client and returns the
+// incoming message together with its payload.
+func receiveAll(t *testing.T, cfg Config, code string) (*wormhole.IncomingMessage, []byte) {
+	t.Helper()
+	receiver := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	msg, err := receiver.Receive(context.Background(), code)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return msg, data
+}
+
+func TestSendDirectoryMode(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	body, contentType := folderUpload(t, "")
+	id := startSend(t, server, body, contentType)
+	code := waitForStatus(t, server, id, "waiting").Code
+
+	// Only wormhole-william's re-packed copy is kept while waiting
+	if _, err := os.Stat(filepath.Join(server.tempDir, id, "upload.zip")); !os.IsNotExist(err) {
+		t.Errorf("uploaded archive still on disk: %v", err)
+	}
+
+	msg, data := receiveAll(t, cfg, code)
+	if msg.Type != wormhole.TransferDirectory {
+		t.Fatalf("Type = %v, want %v", msg.Type, wormhole.TransferDirectory)
+	}
+	if msg.Name != "album" || msg.FileCount != 2 {
+		t.Errorf("directory = %q with %d files, want %q with 2", msg.Name, msg.FileCount, "album")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "a.txt,sub/b.txt" {
+		t.Errorf("directory entries = %v", names)
+	}
+
+	done := waitForStatus(t, server, id, "complete")
+	if done.Filename != "album" || done.ContentType != "directory" {
+		t.Errorf("transfer = %q (%s), want album (directory)", done.Filename, done.ContentType)
+	}
+}
+
+func TestSendZipMode(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	body, contentType := folderUpload(t, "zip")
+	id := startSend(t, server, body, contentType)
+	code := waitForStatus(t, server, id, "waiting").Code
+
+	msg, _ := receiveAll(t, cfg, code)
+	if msg.Type != wormhole.TransferFile || msg.Name != "album.zip" {
+		t.Errorf("received %v %q, want a file named album.zip", msg.Type, msg.Name)
+	}
+	waitForStatus(t, server, id, "complete")
+}
+
+func TestHandleSendFileInvalidMode(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+
+	body, contentType := folderUpload(t, "tarball")
+	req := httptest.NewRequest(http.MethodPost, "/api/send/file", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	server.handleSendFile(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("handleSendFile invalid mode: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics holds the counters behind /metrics. It writes the Prometheus
+// text format itself, which keeps the client library out of the binary.
+type metrics struct {
+	started   counterVec // by type
+	completed counterVec // by type
+	failed    counterVec // by type and error class
+
+	bytesSent     counterVec
+	bytesReceived counterVec
+
+	cleanupRuns    counterVec
+	cleanupRemoved counterVec
+
+	timeToCode     *histogram // by type
+	timeToComplete *histogram // by type
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		timeToCode:     newHistogram(0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30),
+		timeToComplete: newHistogram(1, 5, 15, 60, 300, 900, 1800, 3600),
+	}
+}
+
+// counterVec is a counter keyed by label values.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) add(v float64, labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[strings.Join(labels, "\x00")] += v
+}
+
+func (c *counterVec) inc(labels ...string) { c.add(1, labels...) }
+
+// snapshot returns the label sets and values, sorted by labels.
+func (c *counterVec) snapshot() ([][]string, []float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	labels := make([][]string, len(keys))
+	values := make([]float64, len(keys))
+	for i, k := range keys {
+		if k != "" {
+			labels[i] = strings.Split(k, "\x00")
+		}
+		values[i] = c.values[k]
+	}
+	return labels, values
+}
+
+// histogram counts observations in cumulative buckets per label value.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // one per bound, plus +Inf
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogram) observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[label]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.bounds)+1)}
+		h.series[label] = s
+	}
+	i := sort.SearchFloat64s(h.bounds, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+// Transfer lifecycle hooks
+
+func (m *metrics) transferStarted(t *TransferStatus) {
+	m.started.inc(t.Type)
+}
+
+func (m *metrics) codeAllocated(t *TransferStatus) {
+	m.timeToCode.observe(t.Type, time.Since(t.CreatedAt).Seconds())
+}
+
+// transferCompleted records a successful transfer. Call it once the final
+// byte count is set.
+func (m *metrics) transferCompleted(t *TransferStatus) {
+	m.completed.inc(t.Type)
+	m.timeToComplete.observe(t.Type, time.Since(t.CreatedAt).Seconds())
+	m.countBytes(t)
+}
+
+// transferFailed records a transfer that ended without completing. class
+// is an errorClass or "cancelled", "rejected" or "expired".
+func (m *metrics) transferFailed(t *TransferStatus, class string) {
+	m.failed.inc(t.Type, class)
+	m.countBytes(t)
+}
+
+// countBytes adds whatever a finished transfer moved, partial or not.
+func (m *metrics) countBytes(t *TransferStatus) {
+	if t.Type == "receive" {
+		m.bytesReceived.add(float64(t.Transferred))
+	} else {
+		m.bytesSent.add(float64(t.Transferred))
+	}
+}
+
+// errorClass buckets a transfer error into a small, fixed set of label
+// values. wormhole-william mostly returns plain string errors, so this
+// falls back to matching their text.
+func errorClass(err error) string {
+	var netErr net.Error
+	var pathErr *fs.PathError
+	msg := err.Error()
+	switch {
+	case errors.Is(err, errShuttingDown):
+		return "shutdown"
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return "timeout"
+	case errors.As(err, &pathErr):
+		return "io"
+	case strings.Contains(msg, "decrypt message failed") || strings.Contains(msg, "sha256 mismatch"):
+		return "crypto"
+	case strings.Contains(msg, "TransferError"):
+		return "peer"
+	case strings.Contains(msg, "failed to establish connection") || strings.Contains(msg, "relay server"):
+		return "transit"
+	case errors.Is(err, errCodeInUse) || strings.Contains(msg, "dial ") || strings.Contains(msg, "WS Read") || strings.Contains(msg, "server error"):
+		return "rendezvous"
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := s.metrics
+
+	writeCounter(w, "wormhole_transfers_started_total", "Transfers started.", &m.started, "type")
+	writeCounter(w, "wormhole_transfers_completed_total", "Transfers completed successfully.", &m.completed, "type")
+	writeCounter(w, "wormhole_transfers_failed_total", "Transfers that failed, were cancelled or were rejected.", &m.failed, "type", "class")
+	writeCounter(w, "wormhole_bytes_sent_total", "Bytes handed to receivers.", &m.bytesSent)
+	writeCounter(w, "wormhole_bytes_received_total", "Bytes received from senders.", &m.bytesReceived)
+	writeCounter(w, "wormhole_cleanup_runs_total", "Runs of the expired transfer cleanup.", &m.cleanupRuns)
+	writeCounter(w, "wormhole_cleanup_removed_total", "Expired transfers removed by cleanup.", &m.cleanupRemoved)
+
+	active := map[string]int{"send": 0, "receive": 0}
+	s.store.Range(func(t *TransferStatus) bool {
+		if !t.finished() {
+			active[t.Type]++
+		}
+		return true
+	})
+	writeHeader(w, "wormhole_active_transfers", "Transfers not yet finished.", "gauge")
+	for _, typ := range []string{"receive", "send"} {
+		fmt.Fprintf(w, "wormhole_active_transfers{type=%q} %d\n", typ, active[typ])
+	}
+
+	writeHeader(w, "wormhole_websocket_subscribers", "Open WebSocket status subscriptions.", "gauge")
+	fmt.Fprintf(w, "wormhole_websocket_subscribers %d\n", s.wsConns.Load())
+
+	writeHeader(w, "wormhole_temp_dir_bytes", "Bytes of uploads and received files on disk.", "gauge")
+	fmt.Fprintf(w, "wormhole_temp_dir_bytes %d\n", dirSize(s.tempDir))
+
+	writeHistogram(w, "wormhole_time_to_code_seconds", "Time from starting a send until the mailbox allocated its code.", m.timeToCode)
+	writeHistogram(w, "wormhole_time_to_complete_seconds", "Time from starting a transfer until it completed.", m.timeToComplete)
+
+	writeHeader(w, "wormhole_rate_limited_total", "Requests refused by the per-client rate limit.", "counter")
+	fmt.Fprintf(w, "wormhole_rate_limited_total %d\n", s.limitStats.rateLimited.Load())
+	writeHeader(w, "wormhole_queue_full_total", "Requests refused because the transfer queue was full.", "counter")
+	fmt.Fprintf(w, "wormhole_queue_full_total %d\n", s.limitStats.queueFull.Load())
+	if s.slots != nil {
+		writeHeader(w, "wormhole_transfer_slots_in_use", "Transfers holding one of the concurrent transfer slots.", "gauge")
+		fmt.Fprintf(w, "wormhole_transfer_slots_in_use %d\n", len(s.slots.slots))
+		writeHeader(w, "wormhole_queued_transfers", "Transfers waiting for a free slot.", "gauge")
+		fmt.Fprintf(w, "wormhole_queued_transfers %d\n", s.slots.queued.Load())
+	}
+	if s.relay != nil {
+		stats := &s.relay.stats
+		writeHeader(w, "wormhole_transit_relay_bytes_total", "Bytes the embedded transit relay copied between peers.", "counter")
+		fmt.Fprintf(w, "wormhole_transit_relay_bytes_total %d\n", stats.bytes.Load())
+		writeHeader(w, "wormhole_transit_relay_sessions_total", "Pairs of peers the embedded transit relay connected.", "counter")
+		fmt.Fprintf(w, "wormhole_transit_relay_sessions_total %d\n", stats.sessions.Load())
+		writeHeader(w, "wormhole_transit_relay_connections", "Connections the embedded transit relay is relaying.", "gauge")
+		fmt.Fprintf(w, "wormhole_transit_relay_connections %d\n", stats.active.Load())
+		writeHeader(w, "wormhole_transit_relay_refused_total", "Relay connections refused for a bad handshake or too many waiting.", "counter")
+		fmt.Fprintf(w, "wormhole_transit_relay_refused_total %d\n", stats.refused.Load())
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name, help string, c *counterVec, labelNames ...string) {
+	writeHeader(w, name, help, "counter")
+	labels, values := c.snapshot()
+	if len(labelNames) == 0 && len(values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", name)
+	}
+	for i, v := range values {
+		fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(labelNames, labels[i]), v)
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeHeader(w, name, help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	types := make([]string, 0, len(h.series))
+	for typ := range h.series {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	for _, typ := range types {
+		s := h.series[typ]
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{type=%q,le=\"%g\"} %d\n", name, typ, bound, cumulative)
+		}
+		cumulative += s.counts[len(h.bounds)]
+		fmt.Fprintf(w, "%s_bucket{type=%q,le=\"+Inf\"} %d\n", name, typ, cumulative)
+		fmt.Fprintf(w, "%s_sum{type=%q} %g\n", name, typ, s.sum)
+		fmt.Fprintf(w, "%s_count{type=%q} %d\n", name, typ, cumulative)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", name, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// dirSize adds up the sizes of the regular files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func scrapeMetrics(t *testing.T, server *Server) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleMetrics: got status %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsTextTransfer(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	w := httptest.NewRecorder()
+	server.handleSendText(w, httptest.NewRequest(http.MethodPost, "/api/send/text", strings.NewReader(`{"text":"hello"}`)))
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	id := resp.ID
+	code := waitForStatus(t, server, id, "waiting").Code
+
+	receiver := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+	msg, err := receiver.Receive(context.Background(), code)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	io.Copy(io.Discard, msg)
+	waitForStatus(t, server, id, "complete")
+
+	body := scrapeMetrics(t, server)
+	for _, want := range []string{
+		`wormhole_transfers_started_total{type="send"} 1`,
+		`wormhole_transfers_completed_total{type="send"} 1`,
+		`wormhole_bytes_sent_total 5`,
+		`wormhole_time_to_code_seconds_count{type="send"} 1`,
+		`wormhole_time_to_complete_seconds_bucket{type="send",le="+Inf"} 1`,
+		`wormhole_active_transfers{type="send"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsGauges(t *testing.T) {
+	server := NewServer(Config{MaxActiveTransfers: 2})
+	server.tempDir = t.TempDir()
+	os.WriteFile(filepath.Join(server.tempDir, "data"), make([]byte, 1234), 0644)
+
+	transfer := &TransferStatus{ID: "recv-1", Type: "receive", Status: "receiving"}
+	server.setTransfer(transfer)
+	server.metrics.transferStarted(transfer)
+	server.cancelTransfer("recv-1")
+	server.setTransfer(&TransferStatus{ID: "recv-2", Type: "receive", Status: "offered", CreatedAt: time.Now()})
+	server.cleanupOldTransfers()
+	// Event streams and long polls are not WebSockets
+	server.events.subscribe("recv-2")
+
+	body := scrapeMetrics(t, server)
+	for _, want := range []string{
+		`wormhole_transfers_failed_total{type="receive",class="cancelled"} 1`,
+		`wormhole_active_transfers{type="receive"} 1`,
+		`wormhole_temp_dir_bytes 1234`,
+		`wormhole_cleanup_runs_total 1`,
+		`wormhole_transfer_slots_in_use 0`,
+		`wormhole_rate_limited_total 0`,
+		`wormhole_websocket_subscribers 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("%w: nameplate 42", errCodeClaimTimeout), "timeout"},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, "io"},
+		{errors.New("decrypt message failed"), "crypto"},
+		{errors.New("TransferError: transfer rejected"), "peer"},
+		{fmt.Errorf("dial ws://mailbox: connection refused"), "rendezvous"},
+		{io.ErrUnexpectedEOF, "network"},
+		{errors.New("something else"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
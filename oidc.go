@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie   = "wormhole_session"
+	oidcStateCookie = "wormhole_oidc"
+	sessionTTL      = 12 * time.Hour
+	oidcLoginTTL    = 10 * time.Minute
+)
+
+// oidcProvider implements the OpenID Connect authorization code flow
+// (with PKCE) against a single issuer. A successful login becomes a signed
+// session cookie, which is all later requests are checked against.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	groupsClaim  string
+	secret       []byte
+	client       *http.Client
+
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey // by kid
+}
+
+// session is the payload of the session cookie.
+type session struct {
+	Subject string   `json:"sub"`
+	Name    string   `json:"name"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+// loginState is the payload of the short-lived cookie that carries a login
+// attempt across the round trip to the issuer.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Expires  int64  `json:"exp"`
+}
+
+// newOIDCProvider fetches the issuer's discovery document.
+func newOIDCProvider(ctx context.Context, cfg Config, secret []byte) (*oidcProvider, error) {
+	if cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "" {
+		return nil, errors.New("oidc: client ID and redirect URL are required")
+	}
+
+	p := &oidcProvider{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		groupsClaim:  cfg.OIDCGroupsClaim,
+		secret:       secret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		keys:         make(map[string]*rsa.PublicKey),
+	}
+	if p.groupsClaim == "" {
+		p.groupsClaim = "groups"
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", discovery.Issuer, p.issuer)
+	}
+	p.authEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	p.jwksURI = discovery.JWKSURI
+
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// refreshKeys reloads the issuer's RSA signing keys.
+func (p *oidcProvider) refreshKeys(ctx context.Context) error {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return fmt.Errorf("oidc keys: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *oidcProvider) key(ctx context.Context, kid string) *rsa.PublicKey {
+	p.mu.Lock()
+	key := p.keys[kid]
+	p.mu.Unlock()
+	if key != nil {
+		return key
+	}
+
+	// The issuer may have rotated its keys
+	if err := p.refreshKeys(ctx); err != nil {
+		loggerFrom(ctx).Warn("Failed to refresh OIDC keys", "err", err)
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keys[kid]
+}
+
+// verifyIDToken checks the ID token's signature and standard claims and
+// returns its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+	key := p.key(ctx, header.Kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown id token key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("id token issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], p.clientID) {
+		return nil, errors.New("id token audience mismatch")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() >= int64(exp) {
+		return nil, errors.New("id token expired")
+	}
+	if got, _ := claims["nonce"].(string); !hmac.Equal([]byte(got), []byte(nonce)) {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud any, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings reads a claim that may be a single string or a list.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// handleLogin starts a login by sending the browser to the issuer.
+func (p *oidcProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state := loginState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Expires:  time.Now().Add(oidcLoginTTL).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    signValue(p.secret, oidcStateCookie, state),
+		Path:     "/auth/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// handleCallback finishes a login: it redeems the code, verifies the ID
+// token and issues the session cookie.
+func (p *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	var state loginState
+	if err := verifyValue(p.secret, oidcStateCookie, cookie.Value, &state); err != nil || time.Now().Unix() >= state.Expires {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	if !hmac.Equal([]byte(q.Get("state")), []byte(state.State)) {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := p.exchange(r.Context(), q.Get("code"), state)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("OIDC login failed", "err", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	sess := session{Expires: time.Now().Add(sessionTTL).Unix()}
+	sess.Subject, _ = claims["sub"].(string)
+	for _, claim := range []string{"preferred_username", "email", "sub"} {
+		if name, _ := claims[claim].(string); name != "" {
+			sess.Name = name
+			break
+		}
+	}
+	sess.Groups = claimStrings(claims[p.groupsClaim])
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signValue(p.secret, sessionCookie, sess),
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// exchange redeems an authorization code and returns the verified ID
+// token claims.
+func (p *oidcProvider) exchange(ctx context.Context, code string, state loginState) (map[string]any, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {state.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token endpoint returned no id_token")
+	}
+	return p.verifyIDToken(ctx, token.IDToken, state.Nonce)
+}
+
+// handleLogout drops the session. It does not redirect to the app, which
+// would bounce straight back through the issuer's own session.
+func (p *oidcProvider) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html><title>Signed out</title><p>You have been signed out. <a href="/auth/login">Sign in again</a></p>`)
+}
+
+// Authenticate accepts requests carrying a valid session cookie.
+func (p *oidcProvider) Authenticate(r *http.Request) (*Identity, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var sess session
+	if err := verifyValue(p.secret, sessionCookie, cookie.Value, &sess); err != nil {
+		return nil, false
+	}
+	if time.Now().Unix() >= sess.Expires {
+		return nil, false
+	}
+	return &Identity{Name: sess.Name, Method: "oidc", Groups: sess.Groups}, true
+}
+
+// requireLogin sends browsers without a session to the login page.
+func (s *Server) requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range s.auth {
+			if _, ok := a.Authenticate(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Redirect(w, r, "/auth/login", http.StatusFound)
+	})
+}
+
+// signValue serialises v and appends an HMAC binding it to purpose, so a
+// value signed for one cookie cannot be replayed as another.
+func signValue(secret []byte, purpose string, v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(valueMAC(secret, purpose, payload))
+}
+
+func verifyValue(secret []byte, purpose, signed string, v any) error {
+	payload, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return errors.New("malformed signed value")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, valueMAC(secret, purpose, payload)) {
+		return errors.New("invalid signature")
+	}
+	return decodeSegment(payload, v)
+}
+
+func valueMAC(secret []byte, purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose + "\x00" + payload))
+	return mac.Sum(nil)
+}
+
+// randomToken returns 128 random bits, base64url encoded.
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(newSecret()[:16])
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal in-process OpenID Connect provider. Its
+// authorization endpoint approves every request for a fixed user.
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	user   string
+	groups []string
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorization request
+}
+
+func newMockIssuer(t *testing.T, user string, groups ...string) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, user: user, groups: groups, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := randomToken()
+		m.mu.Lock()
+		m.codes[code] = q
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "wormhole-web" || secret != "client-secret" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		m.mu.Lock()
+		authReq, ok := m.codes[r.Form.Get("code")]
+		delete(m.codes, r.Form.Get("code"))
+		m.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || authReq.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": m.sign(t, m.claims(authReq.Get("nonce"))),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) claims(nonce string) map[string]any {
+	return map[string]any{
+		"iss":                m.URL,
+		"aud":                "wormhole-web",
+		"sub":                "user-1",
+		"preferred_username": m.user,
+		"groups":             m.groups,
+		"nonce":              nonce,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newOIDCServer starts wormhole-web with OIDC login against issuer.
+func newOIDCServer(t *testing.T, issuer *mockIssuer, cfg Config) (*Server, *httptest.Server) {
+	t.Helper()
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	cfg.OIDCIssuer = issuer.URL
+	cfg.OIDCClientID = "wormhole-web"
+	cfg.OIDCClientSecret = "client-secret"
+	cfg.OIDCRedirectURL = ts.URL + "/auth/callback"
+	cfg.OIDCGroupsClaim = "groups"
+
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+	var err error
+	server.oidc, err = newOIDCProvider(context.Background(), cfg, server.secret)
+	if err != nil {
+		t.Fatalf("newOIDCProvider: %v", err)
+	}
+	server.auth = []Authenticator{server.oidc}
+	if handler, err = server.routes(); err != nil {
+		t.Fatal(err)
+	}
+	return server, ts
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t, "alice", "staff", "senders")
+	_, ts := newOIDCServer(t, issuer, Config{
+		SendGroups:    []string{"senders"},
+		ReceiveGroups: []string{"receivers"},
+		AdminGroups:   []string{"admins"},
+	})
+	browser := newBrowser(t)
+
+	// The API refuses anonymous callers
+	resp, err := browser.Get(ts.URL + "/api/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("anonymous /api/me: got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Opening the app goes through the issuer and back
+	resp, err = browser.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("login ended at %s with status %d", resp.Request.URL, resp.StatusCode)
+	}
+
+	resp, err = browser.Get(ts.URL + "/api/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var me struct {
+		Name        string          `json:"name"`
+		Method      string          `json:"method"`
+		Groups      []string        `json:"groups"`
+		Permissions map[string]bool `json:"permissions"`
+	}
+	json.NewDecoder(resp.Body).Decode(&me)
+	resp.Body.Close()
+	if me.Name != "alice" || me.Method != "oidc" || strings.Join(me.Groups, ",") != "staff,senders" {
+		t.Errorf("me = %+v", me)
+	}
+	if !me.Permissions[permSend] || me.Permissions[permReceive] || me.Permissions[permAdmin] {
+		t.Errorf("permissions = %v, want send only", me.Permissions)
+	}
+
+	// Group permissions gate the handlers
+	resp, err = browser.Post(ts.URL+"/api/receive", "application/json", strings.NewReader(`{"code":"7-foo-bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("receive without permission: got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	resp, err = browser.Get(ts.URL + "/api/transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("transfer list without admin: got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// Logging out drops the session
+	resp, err = browser.Get(ts.URL + "/auth/logout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = browser.Get(ts.URL + "/api/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/api/me after logout: got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCAdmin(t *testing.T) {
+	issuer := newMockIssuer(t, "root", "admins")
+	server, ts := newOIDCServer(t, issuer, Config{AdminGroups: []string{"admins"}})
+	server.setTransfer(&TransferStatus{ID: testRecvID, Type: "receive", Status: "complete", Owner: "someone-else", CreatedAt: time.Now()})
+
+	browser := newBrowser(t)
+	resp, err := browser.Get(ts.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Admins see every transfer, including other users'
+	resp, err = browser.Get(ts.URL + "/api/transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transfers []TransferStatus
+	json.NewDecoder(resp.Body).Decode(&transfers)
+	resp.Body.Close()
+	if len(transfers) != 1 || transfers[0].ID != testRecvID {
+		t.Errorf("transfers = %+v", transfers)
+	}
+
+	resp, err = browser.Get(ts.URL + "/api/status?id=" + testRecvID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("admin status of other user's transfer: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestOIDCCallbackRejectsForgedState(t *testing.T) {
+	issuer := newMockIssuer(t, "alice")
+	_, ts := newOIDCServer(t, issuer, Config{})
+
+	browser := newBrowser(t)
+	browser.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	// Start a login but answer with a state the server did not issue
+	resp, err := browser.Get(ts.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = browser.Get(ts.URL + "/auth/callback?code=anything&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged state: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t, "alice")
+	provider, err := newOIDCProvider(context.Background(), Config{
+		OIDCIssuer:      issuer.URL,
+		OIDCClientID:    "wormhole-web",
+		OIDCRedirectURL: "http://localhost/auth/callback",
+	}, newSecret())
+	if err != nil {
+		t.Fatalf("newOIDCProvider: %v", err)
+	}
+
+	other := newMockIssuer(t, "mallory")
+	tests := []struct {
+		name   string
+		token  func() string
+		wantOK bool
+	}{
+		{"valid", func() string { return issuer.sign(t, issuer.claims("n")) }, true},
+		{"wrong nonce", func() string { return issuer.sign(t, issuer.claims("other")) }, false},
+		{"wrong audience", func() string {
+			c := issuer.claims("n")
+			c["aud"] = "someone-else"
+			return issuer.sign(t, c)
+		}, false},
+		{"expired", func() string {
+			c := issuer.claims("n")
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return issuer.sign(t, c)
+		}, false},
+		{"wrong issuer", func() string {
+			c := issuer.claims("n")
+			c["iss"] = other.URL
+			return issuer.sign(t, c)
+		}, false},
+		{"foreign key", func() string { return other.sign(t, issuer.claims("n")) }, false},
+		{"malformed", func() string { return "not.a.jwt" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := provider.verifyIDToken(context.Background(), tt.token(), "n")
+			if (err == nil) != tt.wantOK {
+				t.Errorf("verifyIDToken error = %v, want ok = %v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSessionCookieTampering(t *testing.T) {
+	p := &oidcProvider{secret: newSecret()}
+	value := signValue(p.secret, sessionCookie, session{Name: "alice", Groups: []string{"staff"}, Expires: time.Now().Add(time.Hour).Unix()})
+
+	check := func(value string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		_, ok := p.Authenticate(req)
+		return ok
+	}
+
+	if !check(value) {
+		t.Fatal("valid session rejected")
+	}
+
+	forged := signValue(newSecret(), sessionCookie, session{Name: "alice", Groups: []string{"admins"}, Expires: time.Now().Add(time.Hour).Unix()})
+	if check(forged) {
+		t.Error("session signed with another key accepted")
+	}
+	if check(signValue(p.secret, oidcStateCookie, session{Name: "alice", Expires: time.Now().Add(time.Hour).Unix()})) {
+		t.Error("value signed for another cookie accepted as session")
+	}
+	if check(signValue(p.secret, sessionCookie, session{Name: "alice", Expires: time.Now().Add(-time.Minute).Unix()})) {
+		t.Error("expired session accepted")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	server := NewServer(Config{SendGroups: []string{"senders"}, AdminGroups: []string{"admins"}})
+	server.auth = []Authenticator{&tokenAuth{}}
+
+	tests := []struct {
+		name string
+		id   *Identity
+		perm string
+		want bool
+	}{
+		{"sender sends", &Identity{Groups: []string{"senders"}}, permSend, true},
+		{"no group cannot send", &Identity{}, permSend, false},
+		{"receive is open", &Identity{}, permReceive, true},
+		{"admin sends", &Identity{Groups: []string{"admins"}}, permSend, true},
+		{"sender is not admin", &Identity{Groups: []string{"senders"}}, permAdmin, false},
+		{"anonymous", nil, permReceive, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := server.allowed(tt.id, tt.perm); got != tt.want {
+				t.Errorf("allowed(%+v, %s) = %v, want %v", tt.id, tt.perm, got, tt.want)
+			}
+		})
+	}
+
+	open := NewServer(Config{})
+	if !open.allowed(nil, permSend) || open.allowed(nil, permAdmin) {
+		t.Error("without auth everyone may send and nobody is admin")
+	}
+}
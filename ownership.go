@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Transfer IDs carry 128 random bits so they cannot be guessed, and every
+// transfer comes with a capability token: an HMAC of its ID under a server
+// secret. Only holders of the token may look at or act on the transfer.
+
+const (
+	// capabilityCookie lists the transfers a browser created, signed as a
+	// whole, so that it needs no per-transfer cookies
+	capabilityCookie = "wormhole_transfers"
+	// maxCookieTransfers bounds the cookie's size; the oldest transfers
+	// drop out first
+	maxCookieTransfers = 20
+)
+
+// newTransferID returns an unguessable ID such as "send-<32 hex chars>".
+func newTransferID(kind string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return kind + "-" + hex.EncodeToString(b)
+}
+
+// newSecret returns a fresh random signing key.
+func newSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return b
+}
+
+// loadSecret reads the signing key at path, creating it on first use so
+// capabilities stay valid across restarts.
+func loadSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err == nil && len(secret) >= 32 {
+		return secret, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret = newSecret()
+	if err := os.WriteFile(path, secret, 0600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// capability returns the bearer token granting access to transfer id.
+func (s *Server) capability(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("transfer:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieMAC signs the list of transfer IDs held in the capability cookie.
+func (s *Server) cookieMAC(ids string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("transfers:" + ids))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieTransfers returns the transfer IDs in r's capability cookie, or
+// nil if it has none or its signature does not match. The value is the
+// IDs and the signature, joined by dots.
+func (s *Server) cookieTransfers(r *http.Request) []string {
+	cookie, err := r.Cookie(capabilityCookie)
+	if err != nil {
+		return nil
+	}
+	i := strings.LastIndex(cookie.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(cookie.Value[i+1:]), []byte(s.cookieMAC(cookie.Value[:i]))) {
+		return nil
+	}
+	return strings.Split(cookie.Value[:i], ".")
+}
+
+// authorizeTransfer checks that r may access transfer id: either it carries
+// the transfer's capability, as a bearer token or a "token" query parameter
+// (for WebSocket and download links), or its capability cookie lists the
+// transfer, or it is authenticated as the user who created it or as an
+// admin.
+func (s *Server) authorizeTransfer(r *http.Request, id string) bool {
+	var presented []string
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		presented = append(presented, strings.TrimPrefix(auth, "Bearer "))
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		presented = append(presented, token)
+	}
+
+	want := []byte(s.capability(id))
+	for _, token := range presented {
+		if hmac.Equal([]byte(token), want) {
+			return true
+		}
+	}
+	for _, listed := range s.cookieTransfers(r) {
+		if listed == id {
+			return true
+		}
+	}
+
+	if s.allowed(identityFrom(r.Context()), permAdmin) {
+		return true
+	}
+	if owner := ownerOf(r); owner != "" {
+		if transfer := s.getTransfer(id); transfer != nil && transfer.Owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTransferCreated hands the new transfer's capability to the client:
+// its ID is added to the capability cookie for the browser UI, and the
+// token is in the body for API clients. Transfers that are gone are
+// dropped from the cookie, and it is renewed for another transferTTL.
+func (s *Server) writeTransferCreated(w http.ResponseWriter, r *http.Request, id string) {
+	var ids []string
+	for _, listed := range s.cookieTransfers(r) {
+		if listed != id && s.getTransfer(listed) != nil {
+			ids = append(ids, listed)
+		}
+	}
+	ids = append(ids, id)
+	if len(ids) > maxCookieTransfers {
+		ids = ids[len(ids)-maxCookieTransfers:]
+	}
+	joined := strings.Join(ids, ".")
+	http.SetCookie(w, &http.Cookie{
+		Name:     capabilityCookie,
+		Value:    joined + "." + s.cookieMAC(joined),
+		Path:     "/api/",
+		MaxAge:   int(transferTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":    id,
+		"token": s.capability(id),
+	})
+}
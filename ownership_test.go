@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCapability authorizes req for transfer id with a bearer token.
+func withCapability(server *Server, req *http.Request, id string) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+server.capability(id))
+	return req
+}
+
+func TestNewTransferID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newTransferID("recv")
+		if !validateTransferID(id) {
+			t.Fatalf("newTransferID produced invalid ID %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("newTransferID repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestAuthorizeTransfer(t *testing.T) {
+	server := NewServer(Config{})
+	token := server.capability(testSendID)
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		want    bool
+	}{
+		{"no credentials", func(r *http.Request) {}, false},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }, true},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "id=" + testSendID + "&token=" + token }, true},
+		{"cookie", func(r *http.Request) {
+			ids := testRecvID + "." + testSendID
+			r.AddCookie(&http.Cookie{Name: capabilityCookie, Value: ids + "." + server.cookieMAC(ids)})
+		}, true},
+		{"other transfer's token", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+server.capability(testRecvID))
+		}, false},
+		{"other server's token", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+NewServer(Config{}).capability(testSendID))
+		}, false},
+		{"cookie for other transfer", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: capabilityCookie, Value: testRecvID + "." + server.cookieMAC(testRecvID)})
+		}, false},
+		{"tampered cookie", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: capabilityCookie, Value: testSendID + "." + server.cookieMAC(testRecvID)})
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/status?id="+testSendID, nil)
+			tt.prepare(req)
+			if got := server.authorizeTransfer(req, testSendID); got != tt.want {
+				t.Errorf("authorizeTransfer = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlersRequireCapability(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{
+		ID:        testRecvID,
+		Type:      "receive",
+		Status:    "complete",
+		CreatedAt: time.Now(),
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"status", http.MethodGet, "/api/status?id=" + testRecvID, server.handleStatus},
+		{"websocket", http.MethodGet, "/api/ws?id=" + testRecvID, server.handleWebSocket},
+		{"download", http.MethodGet, "/api/download/" + testRecvID + "/file.txt", server.handleDownload},
+		{"cancel", http.MethodDelete, "/api/transfers/" + testRecvID, server.handleTransfer},
+		{"accept", http.MethodPost, "/api/transfers/" + testRecvID + "/accept", server.handleTransfer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s without capability: got status %d, want %d", tt.method, tt.path, w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestSendTextIssuesCapability(t *testing.T) {
+	server := NewServer(newTestRendezvous(t))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/send/text", strings.NewReader(`{"text":"hello"}`))
+	w := httptest.NewRecorder()
+	server.handleSendText(w, req)
+
+	var resp struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	defer server.cancelTransfer(resp.ID)
+
+	if !validateTransferID(resp.ID) || resp.Token != server.capability(resp.ID) {
+		t.Fatalf("response = %+v", resp)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != capabilityCookie || !strings.HasPrefix(cookies[0].Value, resp.ID+".") {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+	if !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie should be HttpOnly and SameSite=Strict: %+v", cookies[0])
+	}
+
+	// The cookie alone is enough for the browser to follow the transfer
+	status := httptest.NewRequest(http.MethodGet, "/api/status?id="+resp.ID, nil)
+	status.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	server.handleStatus(w, status)
+	if w.Code != http.StatusOK {
+		t.Errorf("status with cookie: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestCapabilityCookieBounded(t *testing.T) {
+	server := NewServer(Config{})
+
+	var cookie *http.Cookie
+	var ids []string
+	for i := 0; i < maxCookieTransfers+5; i++ {
+		id := newTransferID("send")
+		server.setTransfer(&TransferStatus{ID: id, Type: "send", Status: "waiting", CreatedAt: time.Now()})
+		ids = append(ids, id)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/send/text", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.writeTransferCreated(w, req, id)
+		cookie = w.Result().Cookies()[0]
+	}
+
+	// One cookie, holding only the newest transfers
+	if len(cookie.Value) > 4096 {
+		t.Errorf("cookie is %d bytes", len(cookie.Value))
+	}
+	authorized := func(id string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/status?id="+id, nil)
+		req.AddCookie(cookie)
+		return server.authorizeTransfer(req, id)
+	}
+	if !authorized(ids[len(ids)-1]) || !authorized(ids[len(ids)-maxCookieTransfers]) {
+		t.Error("cookie should cover the newest transfers")
+	}
+	if authorized(ids[0]) {
+		t.Error("cookie should have dropped the oldest transfer")
+	}
+
+	// Transfers that are gone are dropped when the cookie is next renewed
+	server.deleteTransfer(ids[len(ids)-1])
+	req := httptest.NewRequest(http.MethodPost, "/api/send/text", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.writeTransferCreated(w, req, testSendID)
+	cookie = w.Result().Cookies()[0]
+	if authorized(ids[len(ids)-1]) || !authorized(testSendID) {
+		t.Errorf("renewed cookie = %s", cookie.Value)
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+
+	first, err := loadSecret(path)
+	if err != nil {
+		t.Fatalf("loadSecret: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("secret file = %v, %v; want mode 0600", info, err)
+	}
+
+	second, err := loadSecret(path)
+	if err != nil || string(second) != string(first) {
+		t.Errorf("reloaded secret differs (err %v)", err)
+	}
+}
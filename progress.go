@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultProgressInterval is how often progress is published when
+	// ProgressInterval is unset
+	defaultProgressInterval = 100 * time.Millisecond
+	// throughputWindow is how far back the throughput average looks
+	throughputWindow = 5 * time.Second
+	// throughputWarmup is how much history is needed before reporting a rate
+	throughputWarmup = 500 * time.Millisecond
+)
+
+// progressTracker counts the bytes a transfer has moved. The data path
+// only stores into its counters; a ticker publishes them as a snapshot
+// every ProgressInterval, so reads never contend on Server.mu.
+type progressTracker struct {
+	transferred atomic.Int64
+	total       atomic.Int64 // zero keeps the transfer's own Total
+	stop        chan struct{}
+
+	// samples is the throughput window, only touched by the ticker
+	samples []progressSample
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// trackProgress returns the tracker of transfer id, starting it on first
+// use. Counting into the tracker of a finished transfer is harmless.
+func (s *Server) trackProgress(id string) *progressTracker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.progress[id]; p != nil {
+		return p
+	}
+
+	p := &progressTracker{stop: make(chan struct{})}
+	t := s.store.Get(id)
+	if t == nil || t.finished() {
+		close(p.stop)
+		return p
+	}
+	p.transferred.Store(t.Transferred)
+	s.progress[id] = p
+
+	interval := s.config.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.publishProgress(id, p, now)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// publishProgress stores the tracker's counters in a new snapshot if they
+// moved, or if the throughput is still decaying after a stall.
+func (s *Server) publishProgress(id string, p *progressTracker, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.store.Get(id)
+	if current == nil || current.finished() {
+		return
+	}
+
+	next := *current
+	next.Transferred = p.transferred.Load()
+	if total := p.total.Load(); total > 0 {
+		next.Total = total
+	}
+	if next.Total > 0 {
+		next.Progress = float64(next.Transferred) / float64(next.Total) * 100
+	}
+	p.measure(&next, now)
+
+	if next.Transferred == current.Transferred && next.Total == current.Total &&
+		next.Throughput == current.Throughput && next.ETA == current.ETA {
+		return
+	}
+	s.commit(current, &next)
+}
+
+// measure fills in t's throughput and ETA from the bytes moved over the
+// last few seconds. Ticks keep adding samples while nothing arrives, so a
+// stalled transfer's rate falls to zero.
+func (p *progressTracker) measure(t *TransferStatus, now time.Time) {
+	p.samples = append(p.samples, progressSample{at: now, bytes: t.Transferred})
+	// Keep one sample at or beyond the window's edge as the baseline
+	for len(p.samples) > 1 && now.Sub(p.samples[1].at) >= throughputWindow {
+		p.samples = p.samples[1:]
+	}
+
+	oldest := p.samples[0]
+	elapsed := now.Sub(oldest.at)
+	if elapsed < throughputWarmup || t.Transferred < oldest.bytes {
+		return
+	}
+	t.Throughput = int64(float64(t.Transferred-oldest.bytes) / elapsed.Seconds())
+	t.ETA = 0
+	if t.Throughput > 0 && t.Total > t.Transferred {
+		t.ETA = (t.Total - t.Transferred + t.Throughput - 1) / t.Throughput
+	}
+}
+
+// finishProgress folds the last counted bytes into a transfer that is
+// finishing and stops its tracker. s.mu must be held.
+func (s *Server) finishProgress(t *TransferStatus) {
+	t.ETA = 0
+	p := s.progress[t.ID]
+	if p == nil {
+		return
+	}
+	if n := p.transferred.Load(); n > t.Transferred {
+		t.Transferred = n
+	}
+	s.forgetProgress(t.ID)
+}
+
+// forgetProgress stops a transfer's tracker. s.mu must be held.
+func (s *Server) forgetProgress(id string) {
+	if p := s.progress[id]; p != nil {
+		close(p.stop)
+		delete(s.progress, id)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestProgressTick(t *testing.T) {
+	server := NewServer(Config{ProgressInterval: 50 * time.Millisecond})
+	server.setTransfer(&TransferStatus{ID: testRecvID, Type: "receive", Status: "receiving", Total: 1000, CreatedAt: time.Now()})
+
+	sub := server.subscribe(testRecvID)
+	defer server.events.unsubscribe(testRecvID, sub)
+	<-sub.queue // current status
+
+	// Counting alone notifies nobody; the tick publishes the latest count
+	p := server.trackProgress(testRecvID)
+	if server.trackProgress(testRecvID) != p {
+		t.Error("second trackProgress started another tracker")
+	}
+	for n := int64(1); n <= 500; n++ {
+		p.transferred.Store(n)
+	}
+	var status TransferStatus
+	select {
+	case ev := <-sub.queue:
+		json.Unmarshal(ev.data, &status)
+	case <-time.After(time.Second):
+		t.Fatal("no progress published")
+	}
+	if status.Transferred != 500 || status.Progress != 50 {
+		t.Errorf("transferred = %d (%v%%), want 500 (50%%)", status.Transferred, status.Progress)
+	}
+
+	// Completing folds in bytes counted since the last tick
+	p.transferred.Store(700)
+	server.completeTransfer(testRecvID, func(t *TransferStatus) {})
+	for status.Status != "complete" {
+		json.Unmarshal((<-sub.queue).data, &status)
+	}
+	if status.Transferred != 700 || status.ETA != 0 {
+		t.Errorf("final transferred = %d, eta = %d; want 700, 0", status.Transferred, status.ETA)
+	}
+	server.mu.Lock()
+	_, ok := server.progress[testRecvID]
+	server.mu.Unlock()
+	if ok {
+		t.Error("tracker kept after the transfer finished")
+	}
+	select {
+	case <-p.stop:
+	default:
+		t.Error("tracker not stopped after the transfer finished")
+	}
+	select {
+	case ev := <-sub.queue:
+		t.Errorf("update after the terminal one: %s", ev.data)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestProgressMeasure(t *testing.T) {
+	var p progressTracker
+	start := time.Now()
+	status := &TransferStatus{Total: 10000}
+
+	// 1000 bytes per second, sampled every 100ms
+	tick := func(i int64) {
+		p.measure(status, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	for i := int64(0); i <= 40; i++ {
+		status.Transferred = i * 100
+		tick(i)
+	}
+	if status.Throughput != 1000 {
+		t.Errorf("Throughput = %d, want 1000", status.Throughput)
+	}
+	if status.ETA != 6 {
+		t.Errorf("ETA = %d, want 6", status.ETA)
+	}
+
+	// A stall brings the rate down, and to zero once the window has passed
+	for i := int64(41); i <= 60; i++ {
+		tick(i)
+	}
+	if status.Throughput == 0 || status.Throughput >= 1000 {
+		t.Errorf("Throughput two seconds into a stall = %d", status.Throughput)
+	}
+	for i := int64(61); i <= 100; i++ {
+		tick(i)
+	}
+	if status.Throughput != 0 || status.ETA != 0 {
+		t.Errorf("Throughput = %d, ETA = %d after a long stall; want 0, 0", status.Throughput, status.ETA)
+	}
+	// Only the last few seconds are kept
+	if n := len(p.samples); n > int(throughputWindow/(100*time.Millisecond))+1 {
+		t.Errorf("kept %d samples", n)
+	}
+}
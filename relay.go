@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// relayHandshakeTimeout is how long a new connection has to say which
+	// transfer it belongs to.
+	relayHandshakeTimeout = 30 * time.Second
+	// relayPendingTimeout is how long a connection waits for its peer.
+	relayPendingTimeout = 10 * time.Minute
+	// relayMaxPending caps the connections waiting for a peer.
+	relayMaxPending = 1000
+	// relayBufferSize is how much is copied at a time.
+	relayBufferSize = 32 << 10
+)
+
+// relayHandshake is the line a transit client opens with. Both sides of a
+// transfer derive the token from their shared key; old clients leave out
+// the side.
+var relayHandshake = regexp.MustCompile(`^please relay ([0-9a-f]{64})(?: for side ([0-9a-f]{1,64}))?\n$`)
+
+var errRelayBusy = errors.New("too many connections waiting for a peer")
+
+// transitRelay is an embedded Magic Wormhole transit relay. It pairs the
+// two connections that present the same handshake token from different
+// sides, answers both with "ok", and copies bytes between them, for peers
+// that cannot reach each other directly. It accepts plain TCP, as the
+// wormhole CLI and wormhole-william speak, and the same stream over
+// WebSocket binary messages for browser peers.
+type transitRelay struct {
+	maxRate  int64 // bytes per second each way per connection; 0 means no cap
+	maxBytes int64 // bytes each way per connection; 0 means no cap
+	upgrader websocket.Upgrader
+
+	mu        sync.Mutex
+	pending   map[string]*relayPeer // by token
+	listeners []io.Closer
+
+	stats relayStats
+}
+
+type relayStats struct {
+	bytes    atomic.Int64 // bytes copied between peers
+	sessions atomic.Int64 // pairs of connections relayed
+	active   atomic.Int64 // connections being relayed now
+	refused  atomic.Int64 // connections with a bad handshake or no room to wait
+}
+
+// relayConn is a TCP connection, or a WebSocket carrying the same stream.
+type relayConn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// relayPeer is a connection that has sent its handshake.
+type relayPeer struct {
+	conn    relayConn
+	r       *bufio.Reader // conn, behind the buffer the handshake was read with
+	side    string
+	partner chan *relayPeer // gets the peer, or nil when given up on
+}
+
+func newTransitRelay(maxRate, maxBytes int64) *transitRelay {
+	return &transitRelay{
+		maxRate:  maxRate,
+		maxBytes: maxBytes,
+		// Browser peers come from pages on any origin
+		upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		pending:  make(map[string]*relayPeer),
+	}
+}
+
+// listenTCP serves the relay on addr and returns the address to hand to
+// peers: host with the listening port, or see advertisedAddr when host is
+// empty.
+func (r *transitRelay) listenTCP(addr, host string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.listeners = append(r.listeners, ln)
+	r.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	if host != "" {
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		return net.JoinHostPort(host, port), nil
+	}
+	return advertisedAddr(ln.Addr()), nil
+}
+
+// listenWebSocket serves the relay to WebSocket peers on addr.
+func (r *transitRelay) listenWebSocket(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: r}
+	r.mu.Lock()
+	r.listeners = append(r.listeners, srv)
+	r.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Transit relay error", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops accepting connections. Relayed ones run on until they end.
+func (r *transitRelay) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range r.listeners {
+		l.Close()
+	}
+	r.listeners = nil
+}
+
+func (r *transitRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ws, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	r.serve(&wsStream{ws: ws})
+}
+
+// serve reads a connection's handshake, waits for its peer and relays
+// its bytes to the peer until either side is done.
+func (r *transitRelay) serve(conn relayConn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(relayHandshakeTimeout))
+	br := bufio.NewReaderSize(conn, relayBufferSize)
+	line, err := br.ReadSlice('\n')
+	m := relayHandshake.FindSubmatch(line)
+	if err != nil || m == nil {
+		r.stats.refused.Add(1)
+		conn.Write([]byte("bad handshake\n"))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	token := string(m[1])
+	peer := &relayPeer{conn: conn, r: br, side: string(m[2]), partner: make(chan *relayPeer, 1)}
+	other, err := r.pair(token, peer)
+	if err != nil {
+		r.stats.refused.Add(1)
+		conn.Write([]byte("error: " + err.Error() + "\n"))
+		return
+	}
+
+	if other != nil {
+		// The second connection tells both to go ahead; neither client
+		// writes before it has read "ok"
+		for _, p := range []*relayPeer{other, peer} {
+			if _, err := p.conn.Write([]byte("ok\n")); err != nil {
+				other.partner <- nil
+				return
+			}
+		}
+		other.partner <- peer
+		r.stats.sessions.Add(1)
+	} else if other = r.await(token, peer); other == nil {
+		return
+	}
+
+	r.stats.active.Add(1)
+	defer r.stats.active.Add(-1)
+	r.copy(other.conn, peer.r)
+	// Either side finishing ends the session for both
+	other.conn.Close()
+}
+
+// pair returns the peer waiting on token from another side, or registers
+// p as waiting and returns nil. A second connection from the same side
+// takes the place of the first.
+func (r *transitRelay) pair(token string, p *relayPeer) (*relayPeer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if other := r.pending[token]; other != nil {
+		delete(r.pending, token)
+		if other.side != p.side || p.side == "" {
+			return other, nil
+		}
+		other.partner <- nil
+	}
+	if len(r.pending) >= relayMaxPending {
+		return nil, errRelayBusy
+	}
+	r.pending[token] = p
+	return nil, nil
+}
+
+// await waits for p's peer. It gives up when the client hangs up or sends
+// data before being told to, or after relayPendingTimeout. Watching for
+// the hangup reads from the connection, so once paired it waits for that
+// read, which returns as soon as the client starts talking.
+func (r *transitRelay) await(token string, p *relayPeer) *relayPeer {
+	readable := make(chan error, 1)
+	go func() {
+		_, err := p.r.Peek(1)
+		readable <- err
+	}()
+
+	timeout := time.NewTimer(relayPendingTimeout)
+	defer timeout.Stop()
+	var err error
+	select {
+	case other := <-p.partner:
+		if other == nil || <-readable != nil {
+			return nil
+		}
+		return other
+	case err = <-readable:
+	case <-timeout.C:
+		err = context.DeadlineExceeded
+	}
+
+	r.mu.Lock()
+	waiting := r.pending[token] == p
+	if waiting {
+		delete(r.pending, token)
+	}
+	r.mu.Unlock()
+	if waiting || err != nil {
+		return nil
+	}
+	// The client heard "ok" and started talking before its peer was
+	// handed over
+	return <-p.partner
+}
+
+// copy relays src to dst within the per-connection limits.
+func (r *transitRelay) copy(dst io.Writer, src io.Reader) {
+	buf := make([]byte, relayBufferSize)
+	start := time.Now()
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if r.maxBytes > 0 && total+int64(n) > r.maxBytes {
+				slog.Warn("Transit connection over its byte limit", "limit", r.maxBytes)
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			total += int64(n)
+			r.stats.bytes.Add(int64(n))
+			if r.maxRate > 0 {
+				// Hold back until the bytes so far fit the rate
+				due := time.Duration(float64(total) / float64(r.maxRate) * float64(time.Second))
+				if wait := due - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// advertisedAddr guesses the relay address peers can connect to: the
+// listening one, or for a wildcard listener this machine's first routable
+// IPv4 address. That may well be a container or bridge address, so it is
+// only a fallback for when no host is configured.
+func advertisedAddr(addr net.Addr) string {
+	host, port, _ := net.SplitHostPort(addr.String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() && ipnet.IP.To4() != nil {
+					host = ipnet.IP.String()
+					break
+				}
+			}
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// wsStream carries a relay stream over a WebSocket: each write is one
+// binary message, and reads run across message boundaries.
+type wsStream struct {
+	ws *websocket.Conn
+	r  io.Reader // the message being read
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			_, r, err := s.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			s.r = r
+		}
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error { return s.ws.Close() }
+
+func (s *wsStream) SetReadDeadline(t time.Time) error { return s.ws.SetReadDeadline(t) }
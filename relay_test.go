@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var relayToken = strings.Repeat("ab", 32)
+
+// newTestRelay serves a transit relay on a free local port and returns it
+// with its address.
+func newTestRelay(t *testing.T, maxRate, maxBytes int64) (*transitRelay, string) {
+	t.Helper()
+	relay := newTransitRelay(maxRate, maxBytes)
+	addr, err := relay.listenTCP("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatalf("listenTCP: %v", err)
+	}
+	t.Cleanup(relay.Close)
+	return relay, addr
+}
+
+// dialRelay connects to the relay and sends the handshake for side.
+func dialRelay(t *testing.T, addr, side string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "please relay "+relayToken+" for side "+side+"\n"); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return conn
+}
+
+// readRelay reads exactly n bytes from conn.
+func readRelay(t *testing.T, conn io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf)
+}
+
+func TestTransitRelayPairs(t *testing.T) {
+	relay, addr := newTestRelay(t, 0, 0)
+
+	a := dialRelay(t, addr, "0000000000000001")
+	waitFor(t, func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return len(relay.pending) == 1
+	})
+	b := dialRelay(t, addr, "0000000000000002")
+	for _, conn := range []net.Conn{a, b} {
+		if got := readRelay(t, conn, 3); got != "ok\n" {
+			t.Fatalf("handshake reply = %q, want ok", got)
+		}
+	}
+
+	io.WriteString(a, "transit sender ready\n\n")
+	if got := readRelay(t, b, 22); got != "transit sender ready\n\n" {
+		t.Errorf("b got %q", got)
+	}
+	io.WriteString(b, "go\n")
+	if got := readRelay(t, a, 3); got != "go\n" {
+		t.Errorf("a got %q", got)
+	}
+
+	// Hanging up one side ends the session for the other
+	a.Close()
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after peer hung up: %v, want EOF", err)
+	}
+	waitFor(t, func() bool { return relay.stats.active.Load() == 0 })
+	if got := relay.stats.bytes.Load(); got != 25 {
+		t.Errorf("bytes = %d, want 25", got)
+	}
+	if got := relay.stats.sessions.Load(); got != 1 {
+		t.Errorf("sessions = %d, want 1", got)
+	}
+}
+
+func TestTransitRelayAdvertisedHost(t *testing.T) {
+	relay := newTransitRelay(0, 0)
+	defer relay.Close()
+	addr, err := relay.listenTCP("127.0.0.1:0", "relay.example")
+	if err != nil {
+		t.Fatalf("listenTCP: %v", err)
+	}
+	if host, port, _ := net.SplitHostPort(addr); host != "relay.example" || port == "0" {
+		t.Errorf("advertised %q, want relay.example with the listening port", addr)
+	}
+}
+
+func TestTransitRelayBadHandshake(t *testing.T) {
+	relay, addr := newTestRelay(t, 0, 0)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "please relay not-a-token\n")
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "bad handshake\n" {
+		t.Errorf("reply = %q, want bad handshake", line)
+	}
+	if got := relay.stats.refused.Load(); got != 1 {
+		t.Errorf("refused = %d, want 1", got)
+	}
+}
+
+func TestTransitRelaySameSide(t *testing.T) {
+	relay, addr := newTestRelay(t, 0, 0)
+
+	// A reconnect from the same side replaces the waiting connection
+	// instead of pairing with it
+	first := dialRelay(t, addr, "0000000000000001")
+	waitFor(t, func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return len(relay.pending) == 1
+	})
+	dialRelay(t, addr, "0000000000000001")
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("replaced connection: read %v, want EOF", err)
+	}
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if len(relay.pending) != 1 {
+		t.Errorf("pending = %d, want the replacement", len(relay.pending))
+	}
+}
+
+func TestTransitRelayLimits(t *testing.T) {
+	relay, addr := newTestRelay(t, 10000, 8000)
+
+	a := dialRelay(t, addr, "0000000000000001")
+	waitFor(t, func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return len(relay.pending) == 1
+	})
+	b := dialRelay(t, addr, "0000000000000002")
+	readRelay(t, a, 3)
+	readRelay(t, b, 3)
+
+	start := time.Now()
+	a.Write(make([]byte, 5000))
+	readRelay(t, b, 5000)
+	a.Write(make([]byte, 1000))
+	readRelay(t, b, 1000)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("6000 bytes at 10000 B/s took %v", elapsed)
+	}
+
+	// Going past the byte cap ends the session
+	a.Write(make([]byte, 4000))
+	if rest, err := io.ReadAll(b); err != nil || len(rest) >= 4000 {
+		t.Errorf("read past the cap: got %d bytes, %v", len(rest), err)
+	}
+	if got := relay.stats.bytes.Load(); got > 8000 {
+		t.Errorf("bytes = %d, want at most the cap", got)
+	}
+}
+
+func TestTransitRelayWebSocket(t *testing.T) {
+	relay, addr := newTestRelay(t, 0, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	wsAddr := ln.Addr().String()
+	ln.Close()
+	if err := relay.listenWebSocket(wsAddr); err != nil {
+		t.Fatalf("listenWebSocket: %v", err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+wsAddr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// A browser may split the handshake across messages
+	ws.WriteMessage(websocket.BinaryMessage, []byte("please relay "+relayToken))
+	ws.WriteMessage(websocket.BinaryMessage, []byte(" for side 0000000000000001\n"))
+	waitFor(t, func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return len(relay.pending) == 1
+	})
+
+	conn := dialRelay(t, addr, "0000000000000002")
+	if got := readRelay(t, conn, 3); got != "ok\n" {
+		t.Fatalf("TCP peer got %q, want ok", got)
+	}
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "ok\n" {
+		t.Fatalf("WebSocket peer got %q, %v, want ok", msg, err)
+	}
+
+	ws.WriteMessage(websocket.BinaryMessage, []byte("from the browser"))
+	if got := readRelay(t, conn, 16); got != "from the browser" {
+		t.Errorf("TCP peer got %q", got)
+	}
+	io.WriteString(conn, "from the CLI")
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "from the CLI" {
+		t.Errorf("WebSocket peer got %q, %v", msg, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// drainPollInterval is how often drain checks for remaining transfers.
+const drainPollInterval = 250 * time.Millisecond
+
+var errShuttingDown = errors.New("server shut down before the transfer finished")
+
+// shutdownNotice is sent to every WebSocket subscriber once the server
+// starts draining.
+type shutdownNotice struct {
+	Event    string    `json:"event"`    // always "shutdown"
+	Deadline time.Time `json:"deadline"` // unfinished transfers are cancelled then
+}
+
+// drain stops the server from taking new transfers and waits for the
+// ones moving data to finish. Transfers that are not, and whatever is
+// still running when ctx is done, are cancelled. Status, WebSockets and
+// downloads keep working meanwhile.
+func (s *Server) drain(ctx context.Context) {
+	s.shuttingDown.Store(true)
+
+	deadline, _ := ctx.Deadline()
+	s.broadcast(shutdownNotice{Event: "shutdown", Deadline: deadline})
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		// Queued transfers should not start now, and ones waiting for a
+		// receiver or for someone to accept an offer may never finish
+		var active []*TransferStatus
+		for _, t := range s.unfinishedTransfers() {
+			if t.Status == "sending" || t.Status == "receiving" {
+				active = append(active, t)
+			} else {
+				s.abortTransfer(t.ID, errShuttingDown)
+			}
+		}
+		if len(active) == 0 {
+			slog.Info("All transfers finished")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Warn("Cancelling unfinished transfers", "count", len(active))
+			for _, t := range active {
+				s.abortTransfer(t.ID, errShuttingDown)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) unfinishedTransfers() []*TransferStatus {
+	var active []*TransferStatus
+	s.store.Range(func(t *TransferStatus) bool {
+		if !t.finished() {
+			active = append(active, t)
+		}
+		return true
+	})
+	return active
+}
+
+// broadcast sends msg to every WebSocket subscriber, whatever transfer
+// they watch.
+func (s *Server) broadcast(msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.events.broadcast(data)
+}
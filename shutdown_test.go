@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDrainRefusesNewTransfers(t *testing.T) {
+	server := NewServer(Config{})
+	server.drain(context.Background())
+
+	w := httptest.NewRecorder()
+	server.limitTransfers(server.handleSendText)(w, httptest.NewRequest(http.MethodPost, "/api/send/text", strings.NewReader(`{"text":"hi"}`)))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("send during shutdown: got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestDrainWaitsForTransfers(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+	transfer := &TransferStatus{ID: testRecvID, Type: "receive", Status: "receiving", CreatedAt: time.Now()}
+	server.setTransfer(transfer)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		transfer.Status = "complete"
+		server.setTransfer(transfer)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.drain(ctx)
+
+	if ctx.Err() != nil {
+		t.Error("drain waited for its deadline instead of the transfer")
+	}
+	if got := server.getTransfer(testRecvID).Status; got != "complete" {
+		t.Errorf("Status = %q, want %q", got, "complete")
+	}
+}
+
+func TestDrainCancelsAtDeadline(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+	transferCtx, cancelTransfer := context.WithCancel(context.Background())
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "sending", CreatedAt: time.Now(), cancel: cancelTransfer})
+	server.setTransfer(&TransferStatus{ID: testRecvID, Type: "receive", Status: "complete", CreatedAt: time.Now()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	server.drain(ctx)
+
+	aborted := server.getTransfer(testSendID)
+	if aborted.Status != "error" || aborted.Error != errShuttingDown.Error() {
+		t.Errorf("unfinished transfer = %q %q, want error %q", aborted.Status, aborted.Error, errShuttingDown)
+	}
+	if transferCtx.Err() == nil {
+		t.Error("drain should cancel the transfer context")
+	}
+	if got := server.getTransfer(testRecvID).Status; got != "complete" {
+		t.Errorf("finished transfer Status = %q, want %q", got, "complete")
+	}
+}
+
+func TestDrainCancelsIdleTransfers(t *testing.T) {
+	server := NewServer(Config{})
+	server.tempDir = t.TempDir()
+	transferCtx, cancelTransfer := context.WithCancel(context.Background())
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "waiting", CreatedAt: time.Now(), cancel: cancelTransfer})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	server.drain(ctx)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %v with only a send waiting for its receiver", elapsed)
+	}
+	aborted := server.getTransfer(testSendID)
+	if aborted.Status != "error" || aborted.Error != errShuttingDown.Error() {
+		t.Errorf("waiting send = %q %q, want error %q", aborted.Status, aborted.Error, errShuttingDown)
+	}
+	if transferCtx.Err() == nil {
+		t.Error("drain should cancel the transfer context")
+	}
+}
+
+func TestDrainNotifiesSubscribers(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "complete", CreatedAt: time.Now()})
+
+	ts := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws?id=" + testSendID
+	header := http.Header{"Authorization": {"Bearer " + server.capability(testSendID)}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Initial status
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	server.drain(ctx)
+
+	var notice shutdownNotice
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&notice); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if notice.Event != "shutdown" || notice.Deadline.IsZero() {
+		t.Errorf("notice = %+v", notice)
+	}
+}
@@ -6,6 +6,7 @@
 import {
   escapeHtml,
   formatBytes,
+  formatDuration,
   isEncryptedText,
   TEXT_MAX_LENGTH,
   THEME_KEY,
@@ -64,6 +65,8 @@ interface SendState {
   encrypt: boolean;
   password: string;
   showPassword: boolean;
+  verify: boolean;
+  customCode: string;
 }
 
 interface ReceiveState {
@@ -79,6 +82,7 @@ interface ReceiveState {
   encryptedData: string | null;
   decryptPassword: string;
   showDecryptPassword: boolean;
+  verify: boolean;
   fileSize?: number;
 }
 
@@ -94,18 +98,34 @@ interface TransferStatusResponse {
   readonly status: string;
   readonly code?: string;
   readonly filename?: string;
+  readonly contentType?: string;
+  readonly fileCount?: number;
   readonly progress: number;
   readonly transferred: number;
   readonly total: number;
+  readonly throughput?: number;
+  readonly eta?: number;
+  readonly verifier?: string;
+  readonly verifierWords?: string[];
   readonly error?: string;
   readonly textContent?: string;
   readonly downloadPath?: string;
 }
 
+// Sent over /api/ws when the server starts shutting down
+interface ShutdownNotice {
+  readonly event: "shutdown";
+  readonly deadline: string;
+}
+
 interface SendResponse {
   readonly id: string;
 }
 
+interface CodeCompletionResponse {
+  readonly completions: string[];
+}
+
 // Extended Window interface for File System Access API
 interface SaveFilePickerOptions {
   readonly suggestedName?: string;
@@ -145,6 +165,9 @@ const STATUS: StatusConstants = {
   PASSWORD_REQUIRED: "password-required",
 };
 
+// Suggestions shown at once while typing a code
+const MAX_CODE_COMPLETIONS: number = 20;
+
 const ICONS: Record<string, string> = {
   upload:
     '<svg width="48" height="48" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="1.5" stroke-linecap="round" stroke-linejoin="round"><path d="M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4"/><polyline points="17 8 12 3 7 8"/><line x1="12" y1="3" x2="12" y2="15"/></svg>',
@@ -158,6 +181,7 @@ const ICONS: Record<string, string> = {
   download16:
     '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><path d="M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4"/><polyline points="7 10 12 15 17 10"/><line x1="12" y1="15" x2="12" y2="3"/></svg>',
   lock: '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><rect x="3" y="11" width="18" height="11" rx="2" ry="2"/><path d="M7 11V7a5 5 0 0 1 10 0v4"/></svg>',
+  shield: '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><path d="M12 22s8-4 8-10V5l-8-3-8 3v7c0 6 8 10 8 10z"/></svg>',
   lockLarge:
     '<svg width="48" height="48" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="1.5" stroke-linecap="round" stroke-linejoin="round"><rect x="3" y="11" width="18" height="11" rx="2" ry="2"/><path d="M7 11V7a5 5 0 0 1 10 0v4"/></svg>',
   eyeOpen:
@@ -185,6 +209,8 @@ const state: AppState = {
     encrypt: false,
     password: "",
     showPassword: false,
+    verify: false,
+    customCode: "",
   },
   receive: {
     status: STATUS.IDLE,
@@ -199,12 +225,14 @@ const state: AppState = {
     encryptedData: null,
     decryptPassword: "",
     showDecryptPassword: false,
+    verify: false,
   },
 };
 
 let sendContainer: HTMLElement | null = null;
 let receiveContainer: HTMLElement | null = null;
 let activeWebSocket: WebSocket | null = null;
+let csrfToken: string | null = null;
 
 // ============================================================
 // UTILITY FUNCTIONS
@@ -277,6 +305,75 @@ function closeActiveWebSocket(): void {
   }
 }
 
+function isShutdownNotice(message: object): message is ShutdownNotice {
+  return (message as Partial<ShutdownNotice>).event === "shutdown";
+}
+
+function shutdownMessage(notice: ShutdownNotice): string {
+  const deadline: Date = new Date(notice.deadline);
+  return `Server is shutting down; unfinished transfers will be cancelled at ${deadline.toLocaleTimeString()}`;
+}
+
+// Speed and time left, once the server has measured them
+function rateText(status: TransferStatusResponse): string {
+  if (status.throughput === undefined) {
+    return "";
+  }
+  let text: string = ` · ${formatBytes(status.throughput)}/s`;
+  if (status.eta !== undefined) {
+    text += ` · ${formatDuration(status.eta)} left`;
+  }
+  return text;
+}
+
+// In verify mode both sides must see the same words before any data moves
+function confirmVerifier(ws: WebSocket, status: TransferStatusResponse): void {
+  const words: string = (status.verifierWords ?? []).join(" ");
+  const match: boolean = window.confirm(
+    `Check that the other side shows the same verification words:\n\n${words}\n\nCommand line clients show the verifier as ${status.verifier ?? ""}\n\nDo they match?`
+  );
+  ws.send(JSON.stringify({ action: match ? "accept" : "reject" }));
+}
+
+// Requests that start a transfer must echo the CSRF cookie in a header
+async function csrfHeaders(): Promise<Record<string, string>> {
+  if (csrfToken === null) {
+    const res: Response = await fetch("/api/csrf");
+    const data: { token: string } = await res.json();
+    csrfToken = data.token;
+  }
+  return { "X-CSRF-Token": csrfToken };
+}
+
+// POSTs with the CSRF header. The cookie may have expired or been cleared
+// since the token was fetched, so a refused request gets a fresh token and
+// is tried once more.
+async function csrfFetch(
+  url: string,
+  headers: Record<string, string>,
+  body: BodyInit
+): Promise<Response> {
+  const post = async (): Promise<Response> =>
+    fetch(url, {
+      method: "POST",
+      headers: { ...headers, ...(await csrfHeaders()) },
+      body,
+    });
+
+  const res: Response = await post();
+  if (res.status !== 403) {
+    return res;
+  }
+  csrfToken = null;
+  return post();
+}
+
+function cancelTransfer(transferId: string): void {
+  void fetch(`/api/transfers/${encodeURIComponent(transferId)}`, {
+    method: "DELETE",
+  });
+}
+
 function startSendWebSocket(transferId: string): void {
   closeActiveWebSocket();
 
@@ -284,9 +381,18 @@ function startSendWebSocket(transferId: string): void {
   activeWebSocket = ws;
 
   ws.onmessage = (event: MessageEvent<string>): void => {
-    const status: TransferStatusResponse = JSON.parse(
+    const message: TransferStatusResponse | ShutdownNotice = JSON.parse(
       event.data
-    ) as TransferStatusResponse;
+    ) as TransferStatusResponse | ShutdownNotice;
+    if (isShutdownNotice(message)) {
+      const statusTextEl: Element | null =
+        document.querySelector(".status-text");
+      if (statusTextEl !== null) {
+        statusTextEl.textContent = shutdownMessage(message);
+      }
+      return;
+    }
+    const status: TransferStatusResponse = message;
 
     if (
       status.status === "waiting" &&
@@ -351,6 +457,29 @@ function startSendWebSocket(transferId: string): void {
           successBox.appendChild(note);
         }
       }
+    } else if (status.status === "queued") {
+      const statusTextEl: Element | null =
+        document.querySelector(".status-text");
+      if (statusTextEl !== null) {
+        statusTextEl.textContent = "Queued, waiting for a free slot...";
+      }
+    } else if (status.status === "verifying") {
+      confirmVerifier(ws, status);
+    } else if (status.status === "rejected") {
+      setSendState({
+        status: STATUS.ERROR,
+        error: "Verification rejected",
+      });
+      ws.close();
+    } else if (
+      status.status === "sending" &&
+      state.send.status === STATUS.SUCCESS
+    ) {
+      const statusTextEl: Element | null =
+        document.querySelector(".status-text");
+      if (statusTextEl !== null) {
+        statusTextEl.textContent = `Sending ${String(Math.round(status.progress))}% · ${formatBytes(status.transferred)} / ${formatBytes(status.total)}${rateText(status)}`;
+      }
     } else if (status.status === "complete") {
       state.send.transferPhase = "complete";
       const particleContainer: HTMLElement | null = $("particleContainer");
@@ -387,9 +516,19 @@ function startReceiveWebSocket(transferId: string): void {
   activeWebSocket = ws;
 
   ws.onmessage = (event: MessageEvent<string>): void => {
-    const status: TransferStatusResponse = JSON.parse(
+    const message: TransferStatusResponse | ShutdownNotice = JSON.parse(
       event.data
-    ) as TransferStatusResponse;
+    ) as TransferStatusResponse | ShutdownNotice;
+    if (isShutdownNotice(message)) {
+      const progressText: Element | null = document.querySelector(
+        ".received-file-name"
+      );
+      if (progressText !== null) {
+        progressText.textContent = shutdownMessage(message);
+      }
+      return;
+    }
+    const status: TransferStatusResponse = message;
 
     if (status.status === "complete") {
       const particleContainer: HTMLElement | null = $("particleContainer");
@@ -459,6 +598,31 @@ function startReceiveWebSocket(transferId: string): void {
         error: status.error ?? "Unknown error",
       });
       ws.close();
+    } else if (status.status === "queued") {
+      const progressText: Element | null = document.querySelector(
+        ".received-file-name"
+      );
+      if (progressText !== null) {
+        progressText.textContent = "Queued, waiting for a free slot...";
+      }
+    } else if (status.status === "offered") {
+      const name: string = status.filename ?? "file";
+      const kind: string =
+        status.contentType === "directory"
+          ? `folder with ${String(status.fileCount ?? 0)} files`
+          : "file";
+      const accept: boolean = window.confirm(
+        `Accept ${kind} "${name}" (${formatBytes(status.total)})?`
+      );
+      ws.send(JSON.stringify({ action: accept ? "accept" : "reject" }));
+    } else if (status.status === "verifying") {
+      confirmVerifier(ws, status);
+    } else if (status.status === "rejected") {
+      setReceiveState({
+        status: STATUS.ERROR,
+        error: "Transfer rejected",
+      });
+      ws.close();
     } else if (status.progress > 0) {
       state.receive.fileSize = status.total;
 
@@ -481,7 +645,7 @@ function startReceiveWebSocket(transferId: string): void {
         const percent: number = Math.round(status.progress);
         progressFill.style.width = String(percent) + "%";
         progressText.textContent = `Receiving ${String(percent)}%`;
-        progressDetail.textContent = `${formatBytes(status.transferred)} / ${formatBytes(status.total)}`;
+        progressDetail.textContent = `${formatBytes(status.transferred)} / ${formatBytes(status.total)}${rateText(status)}`;
       } else {
         setReceiveState({
           progress: {
@@ -519,11 +683,15 @@ async function handleSendText(): Promise<void> {
       text = await encryptText(text, state.send.password);
     }
 
-    const res: Response = await fetch("/api/send/text", {
-      method: "POST",
-      headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ text }),
-    });
+    const res: Response = await csrfFetch(
+      "/api/send/text",
+      { "Content-Type": "application/json" },
+      JSON.stringify({
+        text,
+        code: state.send.customCode.trim(),
+        verify: state.send.verify,
+      })
+    );
 
     if (!res.ok) {
       const error: string = await res.text();
@@ -563,6 +731,13 @@ async function handleSendFile(): Promise<void> {
       filesWithPaths = encryptedFiles;
     }
 
+    if (state.send.verify) {
+      formData.append("verify", "true");
+    }
+    if (state.send.customCode.trim() !== "") {
+      formData.append("code", state.send.customCode.trim());
+    }
+
     const firstFile: FileWithPath | undefined = filesWithPaths[0];
     if (
       filesWithPaths.length === 1 &&
@@ -571,18 +746,17 @@ async function handleSendFile(): Promise<void> {
     ) {
       formData.append("file", firstFile.file);
     } else {
-      const paths: string[] = [];
-      for (const { file, path } of filesWithPaths) {
+      // paths must precede the files so the server can stream them
+      const paths: string[] = filesWithPaths.map(
+        ({ path }: FileWithPath): string => path
+      );
+      formData.append("paths", JSON.stringify(paths));
+      for (const { file } of filesWithPaths) {
         formData.append("files", file);
-        paths.push(path);
       }
-      formData.append("paths", JSON.stringify(paths));
     }
 
-    const res: Response = await fetch("/api/send/file", {
-      method: "POST",
-      body: formData,
-    });
+    const res: Response = await csrfFetch("/api/send/file", {}, formData);
 
     if (!res.ok) {
       const error: string = await res.text();
@@ -612,6 +786,9 @@ function handleSend(): void {
 
 function clearSend(): void {
   closeActiveWebSocket();
+  if (state.send.transferId !== null && state.send.transferPhase !== "complete") {
+    cancelTransfer(state.send.transferId);
+  }
   setSendState({
     status: STATUS.IDLE,
     files: [],
@@ -625,6 +802,8 @@ function clearSend(): void {
     encrypt: false,
     password: "",
     showPassword: false,
+    verify: state.send.verify,
+    customCode: state.send.customCode,
   });
 }
 
@@ -829,9 +1008,19 @@ function getEncryptRowHTML(s: SendState): string {
         <input type="${passwordVisible}" class="encrypt-password" id="encryptPassword" placeholder="Enter password" value="${escapeHtml(s.password)}">
         <button type="button" class="password-toggle" id="togglePasswordBtn">${eyeIcon}</button>
       </div>
+      ${getVerifyToggleHTML("verifyCheckbox", s.verify)}
+      <input type="text" class="encrypt-password custom-code" id="customCode" placeholder="Custom code (optional), e.g. 42-release-bundle" value="${escapeHtml(s.customCode)}" autocomplete="off" spellcheck="false">
     </div>`;
 }
 
+function getVerifyToggleHTML(id: string, checked: boolean): string {
+  return `
+      <label class="encrypt-toggle">
+        <input type="checkbox" class="encrypt-checkbox" id="${id}" ${checked ? "checked" : ""}>
+        <span class="encrypt-label">${ICONS["shield"] ?? ""} Compare verification words before transferring</span>
+      </label>`;
+}
+
 function getSendHTML(s: SendState): string {
   const canSend: boolean =
     (s.status === STATUS.FILES_SELECTED && s.files.length > 0) ||
@@ -1097,6 +1286,20 @@ function attachSendListeners(_s: SendState): void {
     });
   }
 
+  const verifyCheckbox: HTMLElement | null = $("verifyCheckbox");
+  if (verifyCheckbox !== null && verifyCheckbox instanceof HTMLInputElement) {
+    verifyCheckbox.addEventListener("change", (): void => {
+      state.send.verify = verifyCheckbox.checked;
+    });
+  }
+
+  const customCode: HTMLElement | null = $("customCode");
+  if (customCode !== null && customCode instanceof HTMLInputElement) {
+    customCode.addEventListener("input", (): void => {
+      state.send.customCode = customCode.value;
+    });
+  }
+
   if (togglePasswordBtn !== null) {
     togglePasswordBtn.addEventListener("click", (): void => {
       state.send.showPassword = !state.send.showPassword;
@@ -1167,11 +1370,11 @@ async function handleReceive(): Promise<void> {
   setReceiveState({ status: STATUS.RECEIVING, progress: null });
 
   try {
-    const res: Response = await fetch("/api/receive", {
-      method: "POST",
-      headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ code }),
-    });
+    const res: Response = await csrfFetch(
+      "/api/receive",
+      { "Content-Type": "application/json" },
+      JSON.stringify({ code, verify: state.receive.verify })
+    );
 
     if (!res.ok) {
       const error: string = await res.text();
@@ -1193,6 +1396,9 @@ async function handleReceive(): Promise<void> {
 
 function clearReceive(): void {
   closeActiveWebSocket();
+  if (state.receive.transferId !== null && state.receive.status === STATUS.RECEIVING) {
+    cancelTransfer(state.receive.transferId);
+  }
   setReceiveState({
     status: STATUS.IDLE,
     code: "",
@@ -1206,9 +1412,38 @@ function clearReceive(): void {
     encryptedData: null,
     decryptPassword: "",
     showDecryptPassword: false,
+    verify: state.receive.verify,
   });
 }
 
+// Offer wordlist words for the part of the code being typed
+async function updateCodeCompletions(prefix: string): Promise<void> {
+  const list: HTMLElement | null = $("codeCompletions");
+  if (list === null) {
+    return;
+  }
+  if (!prefix.includes("-")) {
+    list.innerHTML = "";
+    return;
+  }
+  try {
+    const res: Response = await fetch(
+      `/api/codes/complete?prefix=${encodeURIComponent(prefix)}`
+    );
+    if (!res.ok || state.receive.code !== prefix) {
+      return;
+    }
+    const data: CodeCompletionResponse =
+      (await res.json()) as CodeCompletionResponse;
+    list.innerHTML = data.completions
+      .slice(0, MAX_CODE_COMPLETIONS)
+      .map((code: string): string => `<option value="${escapeHtml(code)}">`)
+      .join("");
+  } catch {
+    // Completion is a convenience; the code can still be typed in full
+  }
+}
+
 function setReceiveCode(code: string): void {
   state.receive.status = code !== "" ? STATUS.CODE_ENTERED : STATUS.IDLE;
   state.receive.code = code;
@@ -1232,8 +1467,10 @@ function getReceiveHTML(s: ReceiveState): string {
           <div class="receive-icon">${ICONS["download"] ?? ""}</div>
           <p class="receive-text">Receive a file or message</p>
           <div class="receive-input-wrapper">
-            <input type="text" class="input" id="codeInput" placeholder="Enter code" value="${escapeHtml(s.code)}">
+            <input type="text" class="input" id="codeInput" placeholder="Enter code" value="${escapeHtml(s.code)}" list="codeCompletions" autocomplete="off" spellcheck="false">
+            <datalist id="codeCompletions"></datalist>
           </div>
+          <div class="verify-row">${getVerifyToggleHTML("receiveVerifyCheckbox", s.verify)}</div>
           <button class="btn btn-primary" id="receiveBtn" ${s.status === STATUS.IDLE ? "disabled" : ""}>Receive</button>
         </div>`;
 
@@ -1457,6 +1694,7 @@ function attachReceiveListeners(_s: ReceiveState): void {
   if (codeInput !== null && codeInput instanceof HTMLInputElement) {
     codeInput.addEventListener("input", (): void => {
       setReceiveCode(codeInput.value.trim());
+      void updateCodeCompletions(state.receive.code);
     });
     codeInput.addEventListener("keydown", (e: Event): void => {
       if (
@@ -1472,6 +1710,13 @@ function attachReceiveListeners(_s: ReceiveState): void {
   receiveBtn?.addEventListener("click", (): void => {
     void handleReceive();
   });
+
+  const verifyCheckbox: HTMLElement | null = $("receiveVerifyCheckbox");
+  if (verifyCheckbox !== null && verifyCheckbox instanceof HTMLInputElement) {
+    verifyCheckbox.addEventListener("change", (): void => {
+      state.receive.verify = verifyCheckbox.checked;
+    });
+  }
   $("resetReceiveBtn")?.addEventListener("click", clearReceive);
   $("cancelReceiveBtn")?.addEventListener("click", clearReceive);
   $("downloadFileBtn")?.addEventListener("click", (): void => {
@@ -2,6 +2,7 @@ import { describe, expect, test } from "bun:test";
 import {
   escapeHtml,
   formatBytes,
+  formatDuration,
   isEncryptedText,
   ENCRYPTION_MARKER,
   TEXT_MAX_LENGTH,
@@ -77,6 +78,28 @@ describe("formatBytes", (): void => {
   });
 });
 
+describe("formatDuration", (): void => {
+  test("formats seconds", (): void => {
+    expect(formatDuration(0)).toBe("0s");
+    expect(formatDuration(42)).toBe("42s");
+    expect(formatDuration(59.6)).toBe("1m 0s");
+  });
+
+  test("formats minutes", (): void => {
+    expect(formatDuration(60)).toBe("1m 0s");
+    expect(formatDuration(185)).toBe("3m 5s");
+  });
+
+  test("formats hours", (): void => {
+    expect(formatDuration(3600)).toBe("1h 0m");
+    expect(formatDuration(7380)).toBe("2h 3m");
+  });
+
+  test("clamps negative values", (): void => {
+    expect(formatDuration(-5)).toBe("0s");
+  });
+});
+
 describe("isEncryptedText", (): void => {
   test("returns true for encrypted text", (): void => {
     expect(isEncryptedText(ENCRYPTION_MARKER + "somebase64data")).toBe(true);
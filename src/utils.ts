@@ -33,6 +33,20 @@ export function formatBytes(bytes: number): string {
   return String(parseFloat((bytes / Math.pow(k, i)).toFixed(1))) + " " + size;
 }
 
+/**
+ * Format a number of seconds as a short duration, e.g. "42s" or "3m 5s"
+ */
+export function formatDuration(seconds: number): string {
+  const s: number = Math.max(0, Math.round(seconds));
+  if (s < 60) {
+    return String(s) + "s";
+  }
+  if (s < 3600) {
+    return `${String(Math.floor(s / 60))}m ${String(s % 60)}s`;
+  }
+  return `${String(Math.floor(s / 3600))}h ${String(Math.floor((s % 3600) / 60))}m`;
+}
+
 /**
  * Encryption marker for identifying encrypted content
  */
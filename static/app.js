@@ -22,6 +22,16 @@ function formatBytes(bytes) {
   }
   return String(parseFloat((bytes / Math.pow(k, i)).toFixed(1))) + " " + size;
 }
+function formatDuration(seconds) {
+  const s = Math.max(0, Math.round(seconds));
+  if (s < 60) {
+    return String(s) + "s";
+  }
+  if (s < 3600) {
+    return `${String(Math.floor(s / 60))}m ${String(s % 60)}s`;
+  }
+  return `${String(Math.floor(s / 3600))}h ${String(Math.floor(s % 3600 / 60))}m`;
+}
 var ENCRYPTION_MARKER = "WORMHOLE_ENCRYPTED_V1:";
 function isEncryptedText(text) {
   return text?.startsWith(ENCRYPTION_MARKER) ?? false;
@@ -117,6 +127,7 @@ var STATUS = {
   TEXT_RECEIVED: "text-received",
   PASSWORD_REQUIRED: "password-required"
 };
+var MAX_CODE_COMPLETIONS = 20;
 var ICONS = {
   upload: '<svg width="48" height="48" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="1.5" stroke-linecap="round" stroke-linejoin="round"><path d="M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4"/><polyline points="17 8 12 3 7 8"/><line x1="12" y1="3" x2="12" y2="15"/></svg>',
   download: '<svg width="48" height="48" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="1.5" stroke-linecap="round" stroke-linejoin="round"><path d="M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4"/><polyline points="7 10 12 15 17 10"/><line x1="12" y1="15" x2="12" y2="3"/></svg>',
@@ -125,6 +136,7 @@ var ICONS = {
   copy: '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><rect x="9" y="9" width="13" height="13" rx="2" ry="2"/><path d="M5 15H4a2 2 0 0 1-2-2V4a2 2 0 0 1 2-2h9a2 2 0 0 1 2 2v1"/></svg>',
   download16: '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><path d="M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4"/><polyline points="7 10 12 15 17 10"/><line x1="12" y1="15" x2="12" y2="3"/></svg>',
   lock: '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><rect x="3" y="11" width="18" height="11" rx="2" ry="2"/><path d="M7 11V7a5 5 0 0 1 10 0v4"/></svg>',
+  shield: '<svg width="16" height="16" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><path d="M12 22s8-4 8-10V5l-8-3-8 3v7c0 6 8 10 8 10z"/></svg>',
   lockLarge: '<svg width="48" height="48" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="1.5" stroke-linecap="round" stroke-linejoin="round"><rect x="3" y="11" width="18" height="11" rx="2" ry="2"/><path d="M7 11V7a5 5 0 0 1 10 0v4"/></svg>',
   eyeOpen: '<svg width="18" height="18" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><path d="M1 12s4-8 11-8 11 8 11 8-4 8-11 8-11-8-11-8z"/><circle cx="12" cy="12" r="3"/></svg>',
   eyeClosed: '<svg width="18" height="18" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round"><path d="M17.94 17.94A10.07 10.07 0 0 1 12 20c-7 0-11-8-11-8a18.45 18.45 0 0 1 5.06-5.94M9.9 4.24A9.12 9.12 0 0 1 12 4c7 0 11 8 11 8a18.5 18.5 0 0 1-2.16 3.19m-6.72-1.07a3 3 0 1 1-4.24-4.24"/><line x1="1" y1="1" x2="23" y2="23"/></svg>'
@@ -143,7 +155,9 @@ var state = {
     error: null,
     encrypt: false,
     password: "",
-    showPassword: false
+    showPassword: false,
+    verify: false,
+    customCode: ""
   },
   receive: {
     status: STATUS.IDLE,
@@ -157,12 +171,14 @@ var state = {
     needsPassword: false,
     encryptedData: null,
     decryptPassword: "",
-    showDecryptPassword: false
+    showDecryptPassword: false,
+    verify: false
   }
 };
 var sendContainer = null;
 var receiveContainer = null;
 var activeWebSocket = null;
+var csrfToken = null;
 function $(id) {
   return document.getElementById(id);
 }
@@ -204,12 +220,74 @@ function closeActiveWebSocket() {
     activeWebSocket = null;
   }
 }
+function isShutdownNotice(message) {
+  return message.event === "shutdown";
+}
+function shutdownMessage(notice) {
+  const deadline = new Date(notice.deadline);
+  return `Server is shutting down; unfinished transfers will be cancelled at ${deadline.toLocaleTimeString()}`;
+}
+function rateText(status) {
+  if (status.throughput === undefined) {
+    return "";
+  }
+  let text = ` \xB7 ${formatBytes(status.throughput)}/s`;
+  if (status.eta !== undefined) {
+    text += ` \xB7 ${formatDuration(status.eta)} left`;
+  }
+  return text;
+}
+function confirmVerifier(ws, status) {
+  const words = (status.verifierWords ?? []).join(" ");
+  const match = window.confirm(`Check that the other side shows the same verification words:
+
+${words}
+
+Command line clients show the verifier as ${status.verifier ?? ""}
+
+Do they match?`);
+  ws.send(JSON.stringify({ action: match ? "accept" : "reject" }));
+}
+async function csrfHeaders() {
+  if (csrfToken === null) {
+    const res = await fetch("/api/csrf");
+    const data = await res.json();
+    csrfToken = data.token;
+  }
+  return { "X-CSRF-Token": csrfToken };
+}
+async function csrfFetch(url, headers, body) {
+  const post = async () => fetch(url, {
+    method: "POST",
+    headers: { ...headers, ...await csrfHeaders() },
+    body
+  });
+  const res = await post();
+  if (res.status !== 403) {
+    return res;
+  }
+  csrfToken = null;
+  return post();
+}
+function cancelTransfer(transferId) {
+  fetch(`/api/transfers/${encodeURIComponent(transferId)}`, {
+    method: "DELETE"
+  });
+}
 function startSendWebSocket(transferId) {
   closeActiveWebSocket();
   const ws = new WebSocket(getWebSocketUrl(transferId));
   activeWebSocket = ws;
   ws.onmessage = (event) => {
-    const status = JSON.parse(event.data);
+    const message = JSON.parse(event.data);
+    if (isShutdownNotice(message)) {
+      const statusTextEl = document.querySelector(".status-text");
+      if (statusTextEl !== null) {
+        statusTextEl.textContent = shutdownMessage(message);
+      }
+      return;
+    }
+    const status = message;
     if (status.status === "waiting" && state.send.status !== STATUS.SUCCESS) {
       const particleContainer = $("particleContainer");
       if (particleContainer !== null) {
@@ -261,6 +339,24 @@ function startSendWebSocket(transferId) {
           successBox.appendChild(note);
         }
       }
+    } else if (status.status === "queued") {
+      const statusTextEl = document.querySelector(".status-text");
+      if (statusTextEl !== null) {
+        statusTextEl.textContent = "Queued, waiting for a free slot...";
+      }
+    } else if (status.status === "verifying") {
+      confirmVerifier(ws, status);
+    } else if (status.status === "rejected") {
+      setSendState({
+        status: STATUS.ERROR,
+        error: "Verification rejected"
+      });
+      ws.close();
+    } else if (status.status === "sending" && state.send.status === STATUS.SUCCESS) {
+      const statusTextEl = document.querySelector(".status-text");
+      if (statusTextEl !== null) {
+        statusTextEl.textContent = `Sending ${String(Math.round(status.progress))}% \xB7 ${formatBytes(status.transferred)} / ${formatBytes(status.total)}${rateText(status)}`;
+      }
     } else if (status.status === "complete") {
       state.send.transferPhase = "complete";
       const particleContainer = $("particleContainer");
@@ -292,7 +388,15 @@ function startReceiveWebSocket(transferId) {
   const ws = new WebSocket(getWebSocketUrl(transferId));
   activeWebSocket = ws;
   ws.onmessage = (event) => {
-    const status = JSON.parse(event.data);
+    const message = JSON.parse(event.data);
+    if (isShutdownNotice(message)) {
+      const progressText = document.querySelector(".received-file-name");
+      if (progressText !== null) {
+        progressText.textContent = shutdownMessage(message);
+      }
+      return;
+    }
+    const status = message;
     if (status.status === "complete") {
       const particleContainer = $("particleContainer");
       const shouldTransition = particleContainer !== null && state.receive.status === STATUS.RECEIVING;
@@ -358,6 +462,26 @@ function startReceiveWebSocket(transferId) {
         error: status.error ?? "Unknown error"
       });
       ws.close();
+    } else if (status.status === "queued") {
+      const progressText = document.querySelector(
+        ".received-file-name"
+      );
+      if (progressText !== null) {
+        progressText.textContent = "Queued, waiting for a free slot...";
+      }
+    } else if (status.status === "offered") {
+      const name = status.filename ?? "file";
+      const kind = status.contentType === "directory" ? `folder with ${String(status.fileCount ?? 0)} files` : "file";
+      const accept = window.confirm(`Accept ${kind} "${name}" (${formatBytes(status.total)})?`);
+      ws.send(JSON.stringify({ action: accept ? "accept" : "reject" }));
+    } else if (status.status === "verifying") {
+      confirmVerifier(ws, status);
+    } else if (status.status === "rejected") {
+      setReceiveState({
+        status: STATUS.ERROR,
+        error: "Transfer rejected"
+      });
+      ws.close();
     } else if (status.progress > 0) {
       state.receive.fileSize = status.total;
       const progressFill = document.querySelector(".received-file-box .progress-fill");
@@ -367,7 +491,7 @@ function startReceiveWebSocket(transferId) {
         const percent = Math.round(status.progress);
         progressFill.style.width = String(percent) + "%";
         progressText.textContent = `Receiving ${String(percent)}%`;
-        progressDetail.textContent = `${formatBytes(status.transferred)} / ${formatBytes(status.total)}`;
+        progressDetail.textContent = `${formatBytes(status.transferred)} / ${formatBytes(status.total)}${rateText(status)}`;
       } else {
         setReceiveState({
           progress: {
@@ -396,11 +520,15 @@ async function handleSendText() {
     if (state.send.encrypt && state.send.password !== "") {
       text = await encryptText(text, state.send.password);
     }
-    const res = await fetch("/api/send/text", {
-      method: "POST",
-      headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ text })
-    });
+    const res = await csrfFetch(
+      "/api/send/text",
+      { "Content-Type": "application/json" },
+      JSON.stringify({
+        text,
+        code: state.send.customCode.trim(),
+        verify: state.send.verify
+      })
+    );
     if (!res.ok) {
       const error = await res.text();
       throw new Error(error);
@@ -432,21 +560,23 @@ async function handleSendFile() {
       }
       filesWithPaths = encryptedFiles;
     }
+    if (state.send.verify) {
+      formData.append("verify", "true");
+    }
+    if (state.send.customCode.trim() !== "") {
+      formData.append("code", state.send.customCode.trim());
+    }
     const firstFile = filesWithPaths[0];
     if (filesWithPaths.length === 1 && firstFile !== undefined && !firstFile.path.includes("/")) {
       formData.append("file", firstFile.file);
     } else {
-      const paths = [];
-      for (const { file, path } of filesWithPaths) {
+      const paths = filesWithPaths.map(({ path }) => path);
+      formData.append("paths", JSON.stringify(paths));
+      for (const { file } of filesWithPaths) {
         formData.append("files", file);
-        paths.push(path);
       }
-      formData.append("paths", JSON.stringify(paths));
     }
-    const res = await fetch("/api/send/file", {
-      method: "POST",
-      body: formData
-    });
+    const res = await csrfFetch("/api/send/file", {}, formData);
     if (!res.ok) {
       const error = await res.text();
       throw new Error(error);
@@ -471,6 +601,9 @@ function handleSend() {
 }
 function clearSend() {
   closeActiveWebSocket();
+  if (state.send.transferId !== null && state.send.transferPhase !== "complete") {
+    cancelTransfer(state.send.transferId);
+  }
   setSendState({
     status: STATUS.IDLE,
     files: [],
@@ -483,7 +616,9 @@ function clearSend() {
     error: null,
     encrypt: false,
     password: "",
-    showPassword: false
+    showPassword: false,
+    verify: state.send.verify,
+    customCode: state.send.customCode
   });
 }
 function addFiles(fileList, filePaths = null) {
@@ -624,8 +759,17 @@ function getEncryptRowHTML(s) {
         <input type="${passwordVisible}" class="encrypt-password" id="encryptPassword" placeholder="Enter password" value="${escapeHtml(s.password)}">
         <button type="button" class="password-toggle" id="togglePasswordBtn">${eyeIcon}</button>
       </div>
+      ${getVerifyToggleHTML("verifyCheckbox", s.verify)}
+      <input type="text" class="encrypt-password custom-code" id="customCode" placeholder="Custom code (optional), e.g. 42-release-bundle" value="${escapeHtml(s.customCode)}" autocomplete="off" spellcheck="false">
     </div>`;
 }
+function getVerifyToggleHTML(id, checked) {
+  return `
+      <label class="encrypt-toggle">
+        <input type="checkbox" class="encrypt-checkbox" id="${id}" ${checked ? "checked" : ""}>
+        <span class="encrypt-label">${ICONS["shield"] ?? ""} Compare verification words before transferring</span>
+      </label>`;
+}
 function getSendHTML(s) {
   const canSend = s.status === STATUS.FILES_SELECTED && s.files.length > 0 || s.status === STATUS.TEXT_SELECTED && s.textMessage.trim().length > 0;
   const needsPassword = s.encrypt && s.password.trim() === "";
@@ -835,6 +979,18 @@ function attachSendListeners(_s) {
       }
     });
   }
+  const verifyCheckbox = $("verifyCheckbox");
+  if (verifyCheckbox !== null && verifyCheckbox instanceof HTMLInputElement) {
+    verifyCheckbox.addEventListener("change", () => {
+      state.send.verify = verifyCheckbox.checked;
+    });
+  }
+  const customCode = $("customCode");
+  if (customCode !== null && customCode instanceof HTMLInputElement) {
+    customCode.addEventListener("input", () => {
+      state.send.customCode = customCode.value;
+    });
+  }
   if (togglePasswordBtn !== null) {
     togglePasswordBtn.addEventListener("click", () => {
       state.send.showPassword = !state.send.showPassword;
@@ -888,11 +1044,11 @@ async function handleReceive() {
   }
   setReceiveState({ status: STATUS.RECEIVING, progress: null });
   try {
-    const res = await fetch("/api/receive", {
-      method: "POST",
-      headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ code })
-    });
+    const res = await csrfFetch(
+      "/api/receive",
+      { "Content-Type": "application/json" },
+      JSON.stringify({ code, verify: state.receive.verify })
+    );
     if (!res.ok) {
       const error = await res.text();
       throw new Error(error);
@@ -910,6 +1066,9 @@ async function handleReceive() {
 }
 function clearReceive() {
   closeActiveWebSocket();
+  if (state.receive.transferId !== null && state.receive.status === STATUS.RECEIVING) {
+    cancelTransfer(state.receive.transferId);
+  }
   setReceiveState({
     status: STATUS.IDLE,
     code: "",
@@ -922,9 +1081,31 @@ function clearReceive() {
     needsPassword: false,
     encryptedData: null,
     decryptPassword: "",
-    showDecryptPassword: false
+    showDecryptPassword: false,
+    verify: state.receive.verify
   });
 }
+async function updateCodeCompletions(prefix) {
+  const list = $("codeCompletions");
+  if (list === null) {
+    return;
+  }
+  if (!prefix.includes("-")) {
+    list.innerHTML = "";
+    return;
+  }
+  try {
+    const res = await fetch(
+      `/api/codes/complete?prefix=${encodeURIComponent(prefix)}`
+    );
+    if (!res.ok || state.receive.code !== prefix) {
+      return;
+    }
+    const data = await res.json();
+    list.innerHTML = data.completions.slice(0, MAX_CODE_COMPLETIONS).map((code) => `<option value="${escapeHtml(code)}">`).join("");
+  } catch {
+  }
+}
 function setReceiveCode(code) {
   state.receive.status = code !== "" ? STATUS.CODE_ENTERED : STATUS.IDLE;
   state.receive.code = code;
@@ -942,8 +1123,10 @@ function getReceiveHTML(s) {
           <div class="receive-icon">${ICONS["download"] ?? ""}</div>
           <p class="receive-text">Receive a file or message</p>
           <div class="receive-input-wrapper">
-            <input type="text" class="input" id="codeInput" placeholder="Enter code" value="${escapeHtml(s.code)}">
+            <input type="text" class="input" id="codeInput" placeholder="Enter code" value="${escapeHtml(s.code)}" list="codeCompletions" autocomplete="off" spellcheck="false">
+            <datalist id="codeCompletions"></datalist>
           </div>
+          <div class="verify-row">${getVerifyToggleHTML("receiveVerifyCheckbox", s.verify)}</div>
           <button class="btn btn-primary" id="receiveBtn" ${s.status === STATUS.IDLE ? "disabled" : ""}>Receive</button>
         </div>`;
     case STATUS.RECEIVING:
@@ -1130,6 +1313,7 @@ function attachReceiveListeners(_s) {
   if (codeInput !== null && codeInput instanceof HTMLInputElement) {
     codeInput.addEventListener("input", () => {
       setReceiveCode(codeInput.value.trim());
+      void updateCodeCompletions(state.receive.code);
     });
     codeInput.addEventListener("keydown", (e) => {
       if (e instanceof KeyboardEvent && e.key === "Enter" && codeInput.value.trim() !== "") {
@@ -1140,6 +1324,12 @@ function attachReceiveListeners(_s) {
   receiveBtn?.addEventListener("click", () => {
     handleReceive();
   });
+  const verifyCheckbox = $("receiveVerifyCheckbox");
+  if (verifyCheckbox !== null && verifyCheckbox instanceof HTMLInputElement) {
+    verifyCheckbox.addEventListener("change", () => {
+      state.receive.verify = verifyCheckbox.checked;
+    });
+  }
   $("resetReceiveBtn")?.addEventListener("click", clearReceive);
   $("cancelReceiveBtn")?.addEventListener("click", clearReceive);
   $("downloadFileBtn")?.addEventListener("click", () => {
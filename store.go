@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TransferStore keeps track of transfers by ID.
+type TransferStore interface {
+	Get(id string) *TransferStatus
+	Set(t *TransferStatus) error
+	Delete(id string) error
+	// Range calls fn for every transfer until fn returns false.
+	Range(fn func(t *TransferStatus) bool)
+}
+
+// memoryStore is a TransferStore that forgets everything on restart.
+type memoryStore struct {
+	transfers sync.Map
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Get(id string) *TransferStatus {
+	if val, ok := m.transfers.Load(id); ok {
+		return val.(*TransferStatus)
+	}
+	return nil
+}
+
+func (m *memoryStore) Set(t *TransferStatus) error {
+	m.transfers.Store(t.ID, t)
+	return nil
+}
+
+func (m *memoryStore) Delete(id string) error {
+	m.transfers.Delete(id)
+	return nil
+}
+
+func (m *memoryStore) Range(fn func(t *TransferStatus) bool) {
+	m.transfers.Range(func(_, value any) bool {
+		return fn(value.(*TransferStatus))
+	})
+}
+
+// journalEntry is one line of the on-disk journal.
+type journalEntry struct {
+	Op        string          `json:"op"` // "set" or "delete"
+	ID        string          `json:"id"`
+	Transfer  *TransferStatus `json:"transfer,omitempty"`
+	CreatedAt time.Time       `json:"createdAt,omitempty"`
+}
+
+const (
+	// journalCompactMin is how many lines the journal may grow to before it
+	// is compacted while running
+	journalCompactMin = 1000
+	// journalCompactRatio is how many journal lines per live transfer are
+	// tolerated before compacting
+	journalCompactRatio = 4
+)
+
+// journalStore is a TransferStore backed by an append-only JSON-lines
+// file. Transfers are served from memory; the journal is only written when
+// a transfer changes status, so progress updates stay cheap. The journal is
+// compacted every time it is opened, and again once superseded entries
+// outnumber live ones journalCompactRatio to one.
+type journalStore struct {
+	memoryStore
+
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	lines     int               // entries in the journal file
+	persisted map[string]string // transfer ID -> last journaled status
+}
+
+// openJournalStore replays the journal at path and compacts it.
+func openJournalStore(path string) (*journalStore, error) {
+	js := &journalStore{
+		path:      path,
+		persisted: make(map[string]string),
+	}
+
+	if err := js.replay(); err != nil {
+		return nil, err
+	}
+	if err := js.compact(); err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+func (js *journalStore) replay() error {
+	f, err := os.Open(js.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final line from a crash; everything before it is good
+			continue
+		}
+		switch entry.Op {
+		case "set":
+			if entry.Transfer == nil || entry.Transfer.ID != entry.ID {
+				continue
+			}
+			entry.Transfer.CreatedAt = entry.CreatedAt
+			js.memoryStore.Set(entry.Transfer)
+		case "delete":
+			js.memoryStore.Delete(entry.ID)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with one entry per live transfer.
+func (js *journalStore) compact() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.compactLocked()
+}
+
+func (js *journalStore) compactLocked() error {
+	tmpPath := js.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	var writeErr error
+	lines := 0
+	persisted := make(map[string]string)
+	js.memoryStore.Range(func(t *TransferStatus) bool {
+		writeErr = writeJournalEntry(w, setEntry(t))
+		persisted[t.ID] = t.Status
+		lines++
+		return writeErr == nil
+	})
+	if writeErr == nil {
+		writeErr = w.Flush()
+	}
+	if writeErr == nil {
+		writeErr = tmp.Sync()
+	}
+	tmp.Close()
+	if writeErr != nil {
+		os.Remove(tmpPath)
+		return writeErr
+	}
+
+	if err := os.Rename(tmpPath, js.path); err != nil {
+		return err
+	}
+	js.lines = lines
+	js.persisted = persisted
+
+	if js.file != nil {
+		js.file.Close()
+	}
+	js.file, err = os.OpenFile(js.path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+// setEntry is the journal entry recording t. Received text is left out:
+// it is often a secret, and only ever shown once, so it is not worth
+// keeping on disk in plaintext.
+func setEntry(t *TransferStatus) journalEntry {
+	persisted := *t
+	persisted.TextContent = ""
+	return journalEntry{Op: "set", ID: t.ID, Transfer: &persisted, CreatedAt: t.CreatedAt}
+}
+
+func writeJournalEntry(w io.Writer, entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (js *journalStore) Set(t *TransferStatus) error {
+	js.memoryStore.Set(t)
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if status, ok := js.persisted[t.ID]; ok && status == t.Status {
+		return nil
+	}
+	if err := writeJournalEntry(js.file, setEntry(t)); err != nil {
+		return fmt.Errorf("journal %s: %w", t.ID, err)
+	}
+	js.persisted[t.ID] = t.Status
+	js.appended()
+	return nil
+}
+
+func (js *journalStore) Delete(id string) error {
+	js.memoryStore.Delete(id)
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if _, ok := js.persisted[id]; !ok {
+		return nil
+	}
+	delete(js.persisted, id)
+	if err := writeJournalEntry(js.file, journalEntry{Op: "delete", ID: id}); err != nil {
+		return err
+	}
+	js.appended()
+	return nil
+}
+
+// appended counts a new journal line and compacts the journal once it is
+// mostly superseded entries. js.mu must be held.
+func (js *journalStore) appended() {
+	js.lines++
+	if js.lines < journalCompactMin || js.lines < journalCompactRatio*len(js.persisted) {
+		return
+	}
+	// The entry is already written; a failed compaction only leaves the
+	// journal longer than it needs to be
+	if err := js.compactLocked(); err != nil {
+		slog.Warn("Failed to compact transfer journal", "path", js.path, "err", err)
+	}
+}
+
+func (js *journalStore) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.file.Close()
+}
+
+// openDataDir switches the server to a persistent store under dir. Received
+// files live next to the journal so they survive restarts too.
+func (s *Server) openDataDir(dir string) error {
+	filesDir := filepath.Join(dir, "files")
+	if err := os.MkdirAll(filesDir, 0755); err != nil {
+		return err
+	}
+
+	store, err := openJournalStore(filepath.Join(dir, "transfers.jsonl"))
+	if err != nil {
+		return err
+	}
+	secret, err := loadSecret(filepath.Join(dir, "secret"))
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	s.store = store
+	s.secret = secret
+	s.tempDir = filesDir
+	s.recoverTransfers()
+	return nil
+}
+
+// recoverTransfers runs after a restart. Finished transfers stay available
+// as long as their files do, and received text, which the journal leaves
+// out, is gone; anything that was still in flight lost its mailbox
+// connection with the old process and is marked as interrupted.
+func (s *Server) recoverTransfers() {
+	var recovered []*TransferStatus
+	s.store.Range(func(t *TransferStatus) bool {
+		recovered = append(recovered, t)
+		return true
+	})
+
+	for _, t := range recovered {
+		transferDir := filepath.Join(s.tempDir, t.ID)
+
+		if !t.finished() {
+			interrupted := *t
+			interrupted.Status = "error"
+			interrupted.Error = "interrupted"
+			os.RemoveAll(transferDir)
+			s.store.Set(&interrupted)
+			continue
+		}
+
+		if t.Status == "complete" && t.DownloadPath != "" {
+			if _, err := os.Stat(transferDir); err != nil {
+				s.store.Delete(t.ID)
+			}
+		}
+		if t.Status == "complete" && t.Type == "receive" && t.ContentType == "text" {
+			s.store.Delete(t.ID)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+
+	store.Set(&TransferStatus{ID: "send-1", Status: "waiting"})
+	store.Set(&TransferStatus{ID: "send-2", Status: "complete"})
+
+	if got := store.Get("send-1"); got == nil || got.Status != "waiting" {
+		t.Errorf("Get(send-1) = %+v", got)
+	}
+
+	count := 0
+	store.Range(func(*TransferStatus) bool {
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Errorf("Range visited %d transfers, want 2", count)
+	}
+
+	store.Delete("send-1")
+	if store.Get("send-1") != nil {
+		t.Error("Get should return nil after Delete")
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestJournalStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfers.jsonl")
+
+	store, err := openJournalStore(path)
+	if err != nil {
+		t.Fatalf("openJournalStore: %v", err)
+	}
+
+	created := time.Now().Add(-time.Minute).Round(time.Second)
+	transfer := &TransferStatus{ID: "recv-1", Type: "receive", Status: "receiving", CreatedAt: created}
+	store.Set(transfer)
+
+	// Progress-only updates do not touch the journal
+	for i := int64(1); i <= 100; i++ {
+		transfer.Transferred = i
+		store.Set(transfer)
+	}
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("journal has %d lines after progress updates, want 1", n)
+	}
+
+	transfer.Status = "complete"
+	transfer.DownloadPath = "/api/download/recv-1/file.txt"
+	store.Set(transfer)
+	store.Set(&TransferStatus{ID: "send-2", Status: "waiting"})
+	store.Delete("send-2")
+	store.Close()
+
+	// Simulate a crash halfway through a write
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"op":"set","id":"send-3","transf`)
+	f.Close()
+
+	reopened, err := openJournalStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	got := reopened.Get("recv-1")
+	if got == nil {
+		t.Fatal("recv-1 was not restored")
+	}
+	if got.Status != "complete" || got.DownloadPath != transfer.DownloadPath || !got.CreatedAt.Equal(created) {
+		t.Errorf("restored transfer = %+v", got)
+	}
+	if reopened.Get("send-2") != nil || reopened.Get("send-3") != nil {
+		t.Error("deleted and torn entries should not be restored")
+	}
+
+	// Reopening compacts the journal to one line per transfer
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("compacted journal has %d lines, want 1", n)
+	}
+}
+
+func TestJournalStoreCompactsWhileRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfers.jsonl")
+	store, err := openJournalStore(path)
+	if err != nil {
+		t.Fatalf("openJournalStore: %v", err)
+	}
+
+	// Short-lived transfers leave nothing live behind
+	store.Set(&TransferStatus{ID: "kept", Status: "complete"})
+	for i := 0; i < 2*journalCompactMin; i++ {
+		id := fmt.Sprintf("send-%d", i)
+		store.Set(&TransferStatus{ID: id, Status: "waiting"})
+		store.Set(&TransferStatus{ID: id, Status: "complete"})
+		store.Delete(id)
+	}
+	if n := countLines(t, path); n >= journalCompactMin {
+		t.Errorf("journal has %d lines, want it compacted below %d", n, journalCompactMin)
+	}
+
+	// What is left still replays to the same state
+	store.Close()
+	reopened, err := openJournalStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Get("kept") == nil || reopened.Get("send-0") != nil {
+		t.Error("compaction lost or resurrected transfers")
+	}
+}
+
+func TestOpenDataDirRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	// State left behind by a previous process
+	previous, err := openJournalStore(filepath.Join(dir, "transfers.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, transfer := range []*TransferStatus{
+		{ID: "recv-1", Type: "receive", Status: "complete", DownloadPath: "/api/download/recv-1/kept.txt"},
+		{ID: "recv-2", Type: "receive", Status: "complete", DownloadPath: "/api/download/recv-2/gone.txt"},
+		{ID: "recv-3", Type: "receive", Status: "receiving"},
+		{ID: "send-4", Type: "send", Status: "waiting"},
+		{ID: "recv-5", Type: "receive", Status: "complete", ContentType: "text", TextContent: "hunter2"},
+	} {
+		transfer.CreatedAt = time.Now()
+		previous.Set(transfer)
+	}
+	previous.Close()
+
+	os.MkdirAll(filepath.Join(dir, "files", "recv-1"), 0755)
+	os.WriteFile(filepath.Join(dir, "files", "recv-1", "kept.txt"), []byte("kept"), 0644)
+	os.MkdirAll(filepath.Join(dir, "files", "recv-3"), 0755)
+
+	server := NewServer(Config{})
+	if err := server.openDataDir(dir); err != nil {
+		t.Fatalf("openDataDir: %v", err)
+	}
+
+	if server.tempDir != filepath.Join(dir, "files") {
+		t.Errorf("tempDir = %q", server.tempDir)
+	}
+	if got := server.getTransfer("recv-1"); got == nil || got.Status != "complete" {
+		t.Errorf("pending download was not restored: %+v", got)
+	}
+	if server.getTransfer("recv-2") != nil {
+		t.Error("download whose file is gone should be dropped")
+	}
+	if server.getTransfer("recv-5") != nil {
+		t.Error("received text is not journaled, so its transfer should be dropped")
+	}
+	journal, _ := os.ReadFile(filepath.Join(dir, "transfers.jsonl"))
+	if strings.Contains(string(journal), "hunter2") {
+		t.Error("received text was written to the journal")
+	}
+	for _, id := range []string{"recv-3", "send-4"} {
+		got := server.getTransfer(id)
+		if got == nil || got.Status != "error" || got.Error != "interrupted" {
+			t.Errorf("%s = %+v, want error: interrupted", id, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", "recv-3")); !os.IsNotExist(err) {
+		t.Error("partial files of interrupted transfers should be removed")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// sseHeartbeatInterval keeps proxies from timing out an idle stream
+	sseHeartbeatInterval = 15 * time.Second
+	// sseRetry is how long browsers wait before reconnecting a stream
+	sseRetry = 2 * time.Second
+	// maxStatusWait caps how long a long-polling status request is held
+	maxStatusWait = 60 * time.Second
+)
+
+// handleEvents serves GET /api/events?id=, the transfer's status updates
+// as Server-Sent Events, for clients whose proxies break WebSockets. Each
+// event's ID is the snapshot version; a client reconnecting with
+// Last-Event-ID only gets snapshots newer than the one it saw.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+	if !validateTransferID(id) {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeTransfer(r, id) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if s.getTransfer(id) == nil {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// A malformed ID resumes from scratch
+	lastSeen, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	sub := s.subscribe(id)
+	defer s.events.unsubscribe(id, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx from buffering the stream
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case ev := <-sub.queue:
+			if ev.version != 0 && ev.version <= lastSeen {
+				continue
+			}
+			err = writeSSE(w, ev)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-sub.done:
+			// Evicted or shutting down; the client reconnects and resumes
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeSSE writes ev as one Server-Sent Event. Its data is JSON, which
+// never contains a newline.
+func writeSSE(w http.ResponseWriter, ev event) error {
+	if ev.version != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", ev.version); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", ev.data)
+	return err
+}
+
+// parseStatusWait reads the long-poll parameters of GET /api/status: wait,
+// a duration capped at maxStatusWait, and since, the version the client
+// already has.
+func parseStatusWait(r *http.Request) (time.Duration, int64, error) {
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait < 0 {
+		return 0, 0, fmt.Errorf("invalid wait %q", r.URL.Query().Get("wait"))
+	}
+	wait = min(wait, maxStatusWait)
+
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			return 0, 0, fmt.Errorf("invalid since %q", v)
+		}
+	}
+	return wait, since, nil
+}
+
+// waitForUpdate blocks until transfer id has a snapshot newer than version
+// since, wait has passed or ctx is done, and returns the latest snapshot.
+func (s *Server) waitForUpdate(ctx context.Context, id string, since int64, wait time.Duration) *TransferStatus {
+	sub := s.subscribe(id)
+	defer s.events.unsubscribe(id, sub)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case ev := <-sub.queue:
+			if ev.version <= since {
+				continue
+			}
+		case <-timer.C:
+		case <-sub.done:
+		case <-ctx.Done():
+		}
+		return s.getTransfer(id)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE reads the next event with data from a stream, skipping comments
+// and retry hints, and returns its ID and data.
+func readSSE(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var id, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && data != "":
+			return id, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func openEvents(t *testing.T, server *Server, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"?id="+testSendID, nil)
+	req.Header.Set("Authorization", "Bearer "+server.capability(testSendID))
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/events: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func TestHandleEvents(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "waiting", CreatedAt: time.Now()})
+
+	// Registered first so it runs after the streams are closed
+	ts := httptest.NewServer(http.HandlerFunc(server.handleEvents))
+	t.Cleanup(ts.Close)
+
+	stream := openEvents(t, server, ts.URL, "")
+	id, data := readSSE(t, stream)
+	var status TransferStatus
+	if err := json.Unmarshal([]byte(data), &status); err != nil {
+		t.Fatalf("data %q: %v", data, err)
+	}
+	if id != "1" || status.Version != 1 || status.Status != "waiting" {
+		t.Errorf("first event id %s = %+v", id, status)
+	}
+
+	server.updateTransfer(testSendID, func(t *TransferStatus) { t.Status = "sending" })
+	id, data = readSSE(t, stream)
+	if id != "2" || !strings.Contains(data, `"status":"sending"`) {
+		t.Errorf("second event id %s = %s", id, data)
+	}
+
+	// Resuming skips what the client already has
+	resumed := openEvents(t, server, ts.URL, "2")
+	server.updateTransfer(testSendID, func(t *TransferStatus) { t.Transferred = 10 })
+	if id, _ := readSSE(t, resumed); id != "3" {
+		t.Errorf("resumed stream started at id %s, want 3", id)
+	}
+}
+
+func TestHandleEventsErrors(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "waiting", CreatedAt: time.Now()})
+
+	for _, tc := range []struct {
+		url   string
+		token string
+		want  int
+	}{
+		{"/api/events", "", http.StatusBadRequest},
+		{"/api/events?id=bogus", "", http.StatusBadRequest},
+		{"/api/events?id=" + testSendID, "", http.StatusForbidden},
+		{"/api/events?id=" + testRecvID, server.capability(testRecvID), http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		server.handleEvents(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.url, w.Code, tc.want)
+		}
+	}
+}
+
+func longPoll(server *Server, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/status?id="+testSendID+query, nil)
+	req.Header.Set("Authorization", "Bearer "+server.capability(testSendID))
+	w := httptest.NewRecorder()
+	server.handleStatus(w, req)
+	return w
+}
+
+func TestHandleStatusLongPoll(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "waiting", CreatedAt: time.Now()})
+
+	// Something newer than since already exists
+	start := time.Now()
+	w := longPoll(server, "&wait=30s&since=0")
+	if w.Code != http.StatusOK || time.Since(start) > 5*time.Second {
+		t.Fatalf("status = %d after %v", w.Code, time.Since(start))
+	}
+
+	// Held until the next update
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		server.updateTransfer(testSendID, func(t *TransferStatus) { t.Status = "sending" })
+	}()
+	w = longPoll(server, "&wait=30s&since=1")
+	var status TransferStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Version != 2 || status.Status != "sending" {
+		t.Errorf("long poll returned %+v", status)
+	}
+
+	// Nothing new before the wait is over
+	start = time.Now()
+	w = longPoll(server, "&wait=50ms&since=2")
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Version != 2 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("timed out poll returned version %d after %v", status.Version, time.Since(start))
+	}
+
+	for _, query := range []string{"&wait=soon", "&wait=-1s", "&wait=1s&since=x"} {
+		if w := longPoll(server, query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestEventBusCloseAll(t *testing.T) {
+	server := NewServer(Config{})
+	server.setTransfer(&TransferStatus{ID: testSendID, Type: "send", Status: "waiting", CreatedAt: time.Now()})
+
+	done := make(chan struct{})
+	go func() {
+		longPoll(server, "&wait=30s&since=1")
+		close(done)
+	}()
+	waitFor(t, func() bool { return server.events.count() == 1 })
+
+	server.events.closeAll()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll still waiting after closeAll")
+	}
+}
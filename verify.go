@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/psanford/wormhole-william/wordlist"
+)
+
+// verifierWordCount is how many bytes of the verifier are shown as words.
+// Four words carry 32 bits, plenty to spot a man-in-the-middle by eye.
+const verifierWordCount = 4
+
+// verifyPeer returns the VerifierOk hook of a transfer in verify mode. Once
+// the PAKE has succeeded the transfer waits in the "verifying" status, with
+// the verifier on show, until the user confirms or rejects it through
+// decideTransfer. A confirmed transfer goes back to the status it had.
+func (s *Server) verifyPeer(ctx context.Context, id string, decision chan bool) func(string) bool {
+	return func(verifier string) bool {
+		var resume string
+		_, ok := s.updateTransfer(id, func(t *TransferStatus) {
+			resume = t.Status
+			t.Status = "verifying"
+			t.Verifier = verifier
+			t.VerifierWords = verifierWords(verifier)
+			drainDecision(decision)
+		})
+		if !ok {
+			return false
+		}
+
+		select {
+		case accept := <-decision:
+			if accept {
+				s.updateTransfer(id, func(t *TransferStatus) {
+					t.Status = resume
+				})
+				return true
+			}
+			// The library reports the rejection to the peer and fails the
+			// transfer; marking it rejected first keeps that from being
+			// recorded as an error
+			rejected, ok := s.updateTransfer(id, func(t *TransferStatus) {
+				t.Status = "rejected"
+			})
+			if ok {
+				s.metrics.transferFailed(rejected, "rejected")
+			}
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// verifierWords spells the start of a hex verifier with the PGP wordlist,
+// alternating even and odd words like a PGP fingerprint. Both sides of a
+// transfer in this UI show the same words; CLI peers show the hex.
+func verifierWords(verifier string) []string {
+	b, err := hex.DecodeString(verifier)
+	if err != nil {
+		return nil
+	}
+	words := make([]string, 0, verifierWordCount)
+	for i := 0; i < verifierWordCount && i < len(b); i++ {
+		pair := wordlist.RawWords[b[i]]
+		if i%2 == 0 {
+			words = append(words, pair.Even)
+		} else {
+			words = append(words, pair.Odd)
+		}
+	}
+	return words
+}
+
+// drainDecision drops an answer left over from an earlier question, such
+// as a second click on "confirm", so it cannot answer the next one. It
+// runs under Server.mu, like decideTransfer.
+func drainDecision(decision chan bool) {
+	select {
+	case <-decision:
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func TestVerifierWords(t *testing.T) {
+	words := verifierWords("0001ff" + strings.Repeat("00", 29))
+	want := []string{"aardvark", "adviser", "zulu", "adroitness"}
+	if strings.Join(words, " ") != strings.Join(want, " ") {
+		t.Errorf("verifierWords = %v, want %v", words, want)
+	}
+	if verifierWords("not hex") != nil {
+		t.Error("verifierWords should reject a malformed verifier")
+	}
+}
+
+func TestReceiveVerify(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+	server.tempDir = t.TempDir()
+
+	sent := make(chan string, 1)
+	sender := wormhole.Client{
+		RendezvousURL: cfg.RendezvousURL,
+		VerifierOk: func(verifier string) bool {
+			sent <- verifier
+			return true
+		},
+	}
+	code, result, err := sender.SendText(context.Background(), "verified")
+	if err != nil {
+		t.Fatalf("SendText: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/receive", strings.NewReader(`{"code":"`+code+`","verify":true}`))
+	w := httptest.NewRecorder()
+	server.handleReceive(w, req)
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	verifying := waitForStatus(t, server, resp.ID, "verifying")
+	if verifying.Verifier != <-sent || len(verifying.VerifierWords) != verifierWordCount {
+		t.Errorf("verifier = %q %v, want the sender's", verifying.Verifier, verifying.VerifierWords)
+	}
+
+	// Accepting confirms the verifier
+	req = withCapability(server, httptest.NewRequest(http.MethodPost, "/api/transfers/"+resp.ID+"/accept", nil), resp.ID)
+	w = httptest.NewRecorder()
+	server.handleTransfer(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	done := waitForStatus(t, server, resp.ID, "complete")
+	if done.TextContent != "verified" {
+		t.Errorf("TextContent = %q", done.TextContent)
+	}
+	if r := <-result; !r.OK {
+		t.Errorf("sender result = %+v", r)
+	}
+}
+
+func TestSendVerifyReject(t *testing.T) {
+	cfg := newTestRendezvous(t)
+	server := NewServer(cfg)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/send/text", strings.NewReader(`{"text":"secret","verify":true}`))
+	w := httptest.NewRecorder()
+	server.handleSendText(w, req)
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	code := waitForStatus(t, server, resp.ID, "waiting").Code
+
+	received := make(chan error, 1)
+	go func() {
+		receiver := wormhole.Client{RendezvousURL: cfg.RendezvousURL}
+		_, err := receiver.Receive(context.Background(), code)
+		received <- err
+	}()
+
+	waitForStatus(t, server, resp.ID, "verifying")
+	if err := server.decideTransfer(resp.ID, false); err != nil {
+		t.Fatalf("decideTransfer: %v", err)
+	}
+	waitForStatus(t, server, resp.ID, "rejected")
+
+	select {
+	case err := <-received:
+		if err == nil || !strings.Contains(err.Error(), "verification") {
+			t.Errorf("receiver error = %v, want a failed verification", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver never saw the rejection")
+	}
+	if err := server.decideTransfer(resp.ID, true); err != errTransferNotOffered {
+		t.Errorf("late decision error = %v", err)
+	}
+}